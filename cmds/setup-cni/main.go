@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"f5-tool-setup-cni/cnisetup"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/f5devcentral/f5-bigip-rest-go/utils"
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -16,77 +24,339 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+type options struct {
+	bigipConfig    string
+	passwordConfig string
+	kubeConfig     string
+	loglevel       string
+	dryRun         bool
+	planFile       string
+	ciliumValues   string
+	verifyBGP      time.Duration
+	enableRouting  bool
+
+	// daemon mode only
+	metricsAddr    string
+	probeAddr      string
+	readyWindow    time.Duration
+	nodeDebounce   time.Duration
+	leaderElect    bool
+	leaseNamespace string
+	leaseName      string
+	leaseDuration  time.Duration
+	renewDeadline  time.Duration
+	retryPeriod    time.Duration
+}
+
+const usage = `Usage: %s <command> [flags]
+
+Commands:
+  apply      apply the configuration to BIG-IPs and k8s, then exit (default)
+  daemon     apply the configuration, then watch k8s node updates
+  uninstall  remove all the BIG-IP and k8s settings created from the configuration
+  validate   check the configuration file offline, without BIG-IP or k8s access
+
+Run '%s <command> -h' for the flags of each command.
+`
+
 func main() {
-	var bigipConfig, passwordConfig, kubeConfig string
-	var daemonMode bool
-	var loglevel string
-	flag.StringVar(&kubeConfig, "kube-config", "", "Paths to a kubeconfig. Only required if out-of-cluster. i.e. ~/.kube/config")
-	flag.StringVar(&bigipConfig, "bigip-config", "./config.yaml", "BIG-IP configuration yaml file.")
-	flag.StringVar(&passwordConfig, "bigip-password", "./password", "BIG-IP admin password.")
-	flag.BoolVar(&daemonMode, "daemon", false, "run the tool as a daemon to watch k8s node updates")
-	flag.StringVar(&loglevel, "log-level", "info", "logging level: debug, info, warn, error, critical")
-	flag.Parse()
-
-	slog := utils.LogFromContext(context.TODO()).WithLevel(loglevel)
+	// keep compatible with the flat flags without command, i.e. 'setup-cni -daemon'
+	command, args := "apply", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "apply":
+		runApply(args)
+	case "daemon":
+		runDaemon(args)
+	case "uninstall":
+		runUninstall(args)
+	case "validate":
+		runValidate(args)
+	case "help":
+		fmt.Printf(usage, os.Args[0], os.Args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", command)
+		fmt.Fprintf(os.Stderr, usage, os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+}
+
+func (opts *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.kubeConfig, "kube-config", "", "Paths to a kubeconfig. Only required if out-of-cluster. i.e. ~/.kube/config")
+	fs.StringVar(&opts.bigipConfig, "bigip-config", "./config.yaml", "BIG-IP configuration yaml file.")
+	fs.StringVar(&opts.passwordConfig, "bigip-password", "./password", "BIG-IP admin password.")
+	fs.StringVar(&opts.loglevel, "log-level", "info", "logging level: debug, info, warn, error, critical")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "print the BIG-IP and k8s operations to be done without executing them, then exit")
+	fs.StringVar(&opts.planFile, "plan-file", "", "with -dry-run, also write the operations in json format to the file")
+	fs.StringVar(&opts.ciliumValues, "cilium-values-file", "", "write the cilium vtep settings as helm values to the file, instead of patching cilium-config")
+	fs.BoolVar(&opts.enableRouting, "enable-tmos-routing", false, "allow switching BIG-IP from legacy to TMOS routing mode for calico, which is reverted on uninstall")
+	fs.DurationVar(&opts.verifyBGP, "verify-bgp", 0, "after applying, wait up to the duration, i.e. 2m, for the calico bgp sessions to be established, 0 to skip. In daemon mode, the result is logged only")
+}
+
+func (opts *options) addDaemonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.metricsAddr, "metrics-bind-address", "0", "address the prometheus metrics endpoint binds to, i.e. :8080, 0 to disable")
+	fs.StringVar(&opts.probeAddr, "health-probe-bind-address", "0", "address the /healthz and /readyz endpoints bind to, i.e. :8081, 0 to disable")
+	fs.DurationVar(&opts.readyWindow, "ready-sync-window", 0, "not ready if no successful sync of nodes to BIG-IPs within the duration, i.e. 30m, 0 for no limit")
+	fs.DurationVar(&opts.nodeDebounce, "node-debounce-window", 5*time.Second, "delay of syncing nodes after a change, the changes within it are synced at once, 0 to sync immediately")
+	fs.BoolVar(&opts.leaderElect, "leader-elect", false, "enable leader election, so that only one of the daemon replicas updates BIG-IPs at a time")
+	fs.StringVar(&opts.leaseNamespace, "leader-elect-lease-namespace", "", "namespace of the leader election lease, default to the namespace of the pod, required if out-of-cluster")
+	fs.StringVar(&opts.leaseName, "leader-elect-lease-name", "f5-tool-setup-cni", "name of the leader election lease")
+	fs.DurationVar(&opts.leaseDuration, "leader-elect-lease-duration", 15*time.Second, "duration that the other replicas wait before taking over the leadership")
+	fs.DurationVar(&opts.renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "duration that the leader retries refreshing the leadership before giving up")
+	fs.DurationVar(&opts.retryPeriod, "leader-elect-retry-period", 2*time.Second, "duration between the leader election actions")
+}
+
+func runApply(args []string) {
+	var opts options
+	var daemonMode, uninstall bool
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	opts.addFlags(fs)
+	opts.addDaemonFlags(fs)
+	fs.BoolVar(&daemonMode, "daemon", false, "run the tool as a daemon to watch k8s node updates, same as the 'daemon' command")
+	fs.BoolVar(&uninstall, "uninstall", false, "remove all the BIG-IP and k8s settings created from the configuration, same as the 'uninstall' command")
+	fs.Parse(args)
+
+	switch {
+	case uninstall:
+		uninstallWith(&opts)
+	case daemonMode:
+		daemonWith(&opts)
+	default:
+		applyWith(&opts)
+	}
+}
+
+func runDaemon(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	opts.addFlags(fs)
+	opts.addDaemonFlags(fs)
+	fs.Parse(args)
+
+	daemonWith(&opts)
+}
+
+func runUninstall(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	opts.addFlags(fs)
+	fs.Parse(args)
+
+	uninstallWith(&opts)
+}
+
+func runValidate(args []string) {
+	var bigipConfig, output string
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.StringVar(&bigipConfig, "bigip-config", "./config.yaml", "BIG-IP configuration yaml file.")
+	fs.StringVar(&output, "output", "text", "output format of the findings: text, json")
+	fs.Parse(args)
 
 	var config cnisetup.CNIConfigs
-	if err := config.Load(bigipConfig, passwordConfig, kubeConfig); err != nil {
-		slog.Errorf(err.Error())
+	report, err := config.Validate(bigipConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	switch output {
+	case "json":
+		breport, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(2)
+		}
+		fmt.Println(string(breport))
+	default:
+		for _, ce := range report.Errors {
+			fmt.Printf("%s: %s\n", bigipConfig, ce.Error())
+		}
+		for _, entry := range report.Entries {
+			for _, ce := range entry.Errors {
+				fmt.Printf("%s: %s\n", bigipConfig, ce.Error())
+			}
+		}
+		if report.Valid {
+			fmt.Printf("%s: %d entries, valid\n", bigipConfig, len(report.Entries))
+		}
+	}
+
+	if !report.Valid {
 		os.Exit(1)
 	}
+}
 
-	cnictx := cnisetup.CNIContext{CNIConfigs: config, Context: context.TODO()}
-	slog.Infof(cnictx.Dumps())
+func applyWith(opts *options) {
+	cnictx := newCNIContext(opts)
+	err := apply(cnictx)
+	if err == nil && opts.verifyBGP > 0 && !opts.dryRun {
+		err = cnictx.VerifyBGP(opts.verifyBGP)
+	}
+	exitWith(cnictx, opts, err)
+}
 
+func apply(cnictx *cnisetup.CNIContext) error {
 	if err := cnictx.Apply(); err != nil {
+		return err
+	}
+
+	if err := cnisetup.HandleNodeChanges(*cnictx); err != nil {
+		return fmt.Errorf("failed to handle nodes: %s", err.Error())
+	}
+	return nil
+}
+
+// exitWith outputs the plan in dry-run mode, even if it is partial for err, then exits on err.
+func exitWith(cnictx *cnisetup.CNIContext, opts *options, err error) {
+	slog := utils.LogFromContext(context.TODO())
+	if opts.dryRun {
+		outputPlan(cnictx.Plan, opts.planFile)
+	}
+	if err != nil {
 		slog.Errorf(err.Error())
 		os.Exit(1)
 	}
+}
+
+func uninstallWith(opts *options) {
+	cnictx := newCNIContext(opts)
+	err := cnictx.Delete()
+	if err != nil {
+		err = fmt.Errorf("failed to uninstall: %s", err.Error())
+	}
+	exitWith(cnictx, opts, err)
+}
 
-	if err := cnisetup.HandleNodeChanges(cnictx); err != nil {
-		slog.Errorf("failed to handle nodes: %s", err.Error())
+func daemonWith(opts *options) {
+	slog := utils.LogFromContext(context.TODO()).WithLevel(opts.loglevel)
+	cnictx := newCNIContext(opts)
+	if opts.dryRun {
+		exitWith(cnictx, opts, apply(cnictx))
+		return
+	}
+
+	restconf, err := newRestConfig(opts.kubeConfig)
+	if err != nil {
+		slog.Errorf("failed to get kube config: %s", err.Error())
+		os.Exit(1)
+	}
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	mgrOpts := ctrl.Options{
+		Scheme:                        scheme,
+		MetricsBindAddress:            opts.metricsAddr,
+		HealthProbeBindAddress:        opts.probeAddr,
+		LeaderElection:                opts.leaderElect,
+		LeaderElectionNamespace:       opts.leaseNamespace,
+		LeaderElectionID:              opts.leaseName,
+		LeaderElectionReleaseOnCancel: true,
+		LeaseDuration:                 &opts.leaseDuration,
+		RenewDeadline:                 &opts.renewDeadline,
+		RetryPeriod:                   &opts.retryPeriod,
+	}
+	if namespaces := cnictx.CNIConfigs.SecretNamespaces(); len(namespaces) > 0 {
+		// only the Secrets in the namespaces referred by secretRef are cached, besides the cluster-scoped Nodes.
+		mgrOpts.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	mgr, err := ctrl.NewManager(restconf, mgrOpts)
+	if err != nil {
+		slog.Errorf("unable to start manager: %s", err.Error())
 		os.Exit(1)
 	}
 
-	if daemonMode {
-		restconf := newRestConfig(kubeConfig)
-		scheme := runtime.NewScheme()
-		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
-		mgr, err := ctrl.NewManager(restconf, ctrl.Options{
-			Scheme:                 scheme,
-			MetricsBindAddress:     "0",
-			HealthProbeBindAddress: "0",
-		})
-		if err != nil {
-			slog.Errorf("unable to start manager: %s", err.Error())
-			os.Exit(1)
+	readyChecker := cnictx.ReadyChecker(opts.readyWindow)
+	err = mgr.AddReadyzCheck("bigip-sync", func(req *http.Request) error {
+		select {
+		case <-mgr.Elected():
+			return readyChecker(req)
+		default:
+			// the standby replicas are ready to take over the leadership.
+			return nil
 		}
+	})
+	if err == nil {
+		err = mgr.AddHealthzCheck("ping", healthz.Ping)
+	}
+	if err != nil {
+		slog.Errorf("unable to set up health checks: %s", err.Error())
+		os.Exit(1)
+	}
 
-		if err := cnictx.OnTrace(mgr, utils.LogLevel_Type_DEBUG); err != nil {
-			slog.Errorf("failed to trace on config: %s", err.Error())
-			os.Exit(1)
+	// apply and watch in the leader only, which starts at once without leader election.
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		slog.Infof("start applying the configuration and watching the changes")
+		if err := apply(cnictx); err != nil {
+			return err
 		}
-
-		if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-			slog.Errorf("failed to start manager: %s", err)
-			os.Exit(1)
+		if err := cnictx.OnTrace(mgr, opts.loglevel); err != nil {
+			return fmt.Errorf("failed to trace on config: %s", err.Error())
+		}
+		// only reported in daemon mode, the manager keeps running and syncing nodes with the sessions not established.
+		if opts.verifyBGP > 0 {
+			go func() {
+				if err := cnictx.VerifyBGP(opts.verifyBGP); err != nil {
+					slog.Warnf(err.Error())
+				}
+			}()
 		}
+		return nil
+	}))
+	if err != nil {
+		slog.Errorf("unable to add the runnable to manager: %s", err.Error())
+		os.Exit(1)
+	}
+
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		slog.Errorf("failed to start manager: %s", err)
+		os.Exit(1)
 	}
 }
 
-func newRestConfig(kubeConfig string) *rest.Config {
-	var config *rest.Config
-	var err error
+func newCNIContext(opts *options) *cnisetup.CNIContext {
+	slog := utils.LogFromContext(context.TODO()).WithLevel(opts.loglevel)
+
+	var config cnisetup.CNIConfigs
+	if err := config.Load(opts.bigipConfig, opts.passwordConfig, opts.kubeConfig); err != nil {
+		slog.Errorf(err.Error())
+		os.Exit(1)
+	}
+
+	cnictx := cnisetup.CNIContext{
+		CNIConfigs:        config,
+		Context:           context.TODO(),
+		CiliumValuesFile:  opts.ciliumValues,
+		EnableTMOSRouting: opts.enableRouting,
+		NodeDebounce:      opts.nodeDebounce,
+	}
+	slog.Infof(cnictx.Dumps())
+	if opts.dryRun {
+		cnictx.Plan = &cnisetup.CNIPlan{}
+	}
+	return &cnictx
+}
+
+func outputPlan(plan *cnisetup.CNIPlan, planFile string) {
+	slog := utils.LogFromContext(context.TODO())
+	fmt.Println(plan.String())
+	if planFile == "" {
+		return
+	}
+	jplan, err := plan.Dumps()
+	if err == nil {
+		err = os.WriteFile(planFile, []byte(jplan), 0644)
+	}
+	if err != nil {
+		slog.Errorf("failed to output the plan: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+func newRestConfig(kubeConfig string) (*rest.Config, error) {
 	if kubeConfig == "" {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
-		if nil != err {
-			panic(err)
-		}
+		return rest.InClusterConfig()
 	}
-	return config
+	return clientcmd.BuildConfigFromFlags("", kubeConfig)
 }
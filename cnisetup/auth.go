@@ -0,0 +1,256 @@
+package cnisetup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	f5_bigip "f5-tool-setup-cni/third_party/f5-bigip-rest-go/bigip"
+)
+
+// tokenRefreshAhead is how long before the expiry a token is refreshed.
+const tokenRefreshAhead = 60 * time.Second
+
+// bigipConn keeps the http client of a BIG-IP across the runs, so that
+// the connections and the auth token are reused between reconciles.
+type bigipConn struct {
+	client  *http.Client
+	session *tokenSession
+	probe   *probeTransport
+}
+
+// tokenSession logs in BIG-IP for a token, and refreshes it before expiry.
+type tokenSession struct {
+	mutex             sync.Mutex
+	url               string
+	loginProviderName string
+	credentials       func() (string, string)
+	transport         http.RoundTripper
+	token             string
+	expiry            time.Time
+}
+
+// probeTransport records the result of the last REST call, for the readiness check.
+type probeTransport struct {
+	base    http.RoundTripper
+	mutex   sync.Mutex
+	called  bool
+	lastErr error
+}
+
+// tokenTransport replaces the basic authorization with the X-F5-Auth-Token header.
+type tokenTransport struct {
+	base    http.RoundTripper
+	session *tokenSession
+}
+
+var connsLock sync.Mutex
+
+// connKey is the context key of the connection of BIGIPContext, for the calls not in f5-bigip-rest-go.
+type connKey struct{}
+
+// newBIGIPContext creates the client of the BIG-IP with the current credentials,
+// which may be changed by the SecretReconciler in daemon mode.
+func (cniconf *CNIConfig) newBIGIPContext(ctx context.Context) (*f5_bigip.BIGIPContext, error) {
+	conn, err := cniconf.connection()
+	if err != nil {
+		return nil, err
+	}
+	authorization := ""
+	if conn.session == nil {
+		username, password := cniconf.credentials()
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	bip := *f5_bigip.NewWithClient(cniconf.bigipUrl(), authorization, conn.client)
+
+	bc := &f5_bigip.BIGIPContext{BIGIP: bip, Context: context.WithValue(quietContext(ctx), connKey{}, conn)}
+	if _, err := bc.All("sys/version"); err != nil {
+		if isTLSError(err) {
+			return nil, fmt.Errorf("BIGIP %s failed TLS verification, check caFile, caBundle and serverName "+
+				"in management, or set insecureSkipVerify explicitly: %s", bip.URL, err.Error())
+		}
+		return nil, fmt.Errorf("BIGIP %s is unavailable: %s", bip.URL, err.Error())
+	}
+	return bc, nil
+}
+
+func (cniconf *CNIConfig) connection() (*bigipConn, error) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	if cniconf.conn != nil {
+		return cniconf.conn, nil
+	}
+
+	tlsConfig, err := cniconf.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup TLS for BIG-IP %s: %s", cniconf.Management.IpAddress, err.Error())
+	}
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	conn := &bigipConn{}
+	if cniconf.Management.AuthType == "token" {
+		conn.session = &tokenSession{
+			url:               cniconf.bigipUrl(),
+			loginProviderName: cniconf.Management.LoginProviderName,
+			credentials:       cniconf.credentials,
+			transport:         transport,
+		}
+		transport = &tokenTransport{base: transport, session: conn.session}
+	}
+	conn.probe = &probeTransport{base: transport}
+	conn.client = &http.Client{Transport: conn.probe, Timeout: 60 * time.Second}
+	cniconf.conn = conn
+	return conn, nil
+}
+
+// tlsConfig verifies BIG-IP certificate with the system CAs and the configured ones,
+// unless insecureSkipVerify is set.
+func (cniconf *CNIConfig) tlsConfig() (*tls.Config, error) {
+	mgmt := &cniconf.Management
+	if mgmt.InsecureSkipVerify {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if mgmt.CaFile != "" {
+		pem, err := os.ReadFile(mgmt.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read caFile: %s", err.Error())
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in caFile %s", mgmt.CaFile)
+		}
+	}
+	if mgmt.CaBundle != "" {
+		if !pool.AppendCertsFromPEM([]byte(mgmt.CaBundle)) {
+			return nil, fmt.Errorf("no certificate found in caBundle")
+		}
+	}
+	return &tls.Config{RootCAs: pool, ServerName: mgmt.ServerName}, nil
+}
+
+// isTLSError tells whether err is of certificate verification, the errors from f5-bigip-rest-go are flattened to strings.
+func isTLSError(err error) bool {
+	for _, s := range []string{"x509: ", "tls: "} {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pt *probeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := pt.base.RoundTrip(req)
+	lastErr := err
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode >= http.StatusInternalServerError) {
+		lastErr = fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.called, pt.lastErr = true, lastErr
+	return resp, err
+}
+
+// LastError returns the error of the last REST call, nil if it succeeded.
+func (pt *probeTransport) LastError() error {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	if !pt.called {
+		return fmt.Errorf("no REST call is done yet")
+	}
+	return pt.lastErr
+}
+
+func (tt *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := tt.session.Token()
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.Header.Del("Authorization")
+	r.Header.Set("X-F5-Auth-Token", token)
+	resp, err := tt.base.RoundTrip(r)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		tt.session.Invalidate()
+	}
+	return resp, err
+}
+
+// Token returns a valid token, logging in again if it expires soon.
+func (ts *tokenSession) Token() (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.token != "" && time.Until(ts.expiry) > tokenRefreshAhead {
+		return ts.token, nil
+	}
+	return ts.login()
+}
+
+// Invalidate drops the token, i.e. after the credentials are rotated.
+func (ts *tokenSession) Invalidate() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.token = ""
+}
+
+func (ts *tokenSession) login() (string, error) {
+	username, password := ts.credentials()
+	body := map[string]string{
+		"username": username,
+		"password": password,
+	}
+	if ts.loginProviderName != "" {
+		body["loginProviderName"] = ts.loginProviderName
+	}
+	bbody, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", ts.url+"/mgmt/shared/authn/login", bytes.NewReader(bbody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := ts.transport.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to login %s: %s", ts.url, err.Error())
+	}
+	defer resp.Body.Close()
+	bresp, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to login %s: %s", ts.url, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to login %s as %s: %d, %s", ts.url, username, resp.StatusCode, bresp)
+	}
+
+	var jresp struct {
+		Token struct {
+			Token   string
+			Timeout int
+		}
+	}
+	if err := json.Unmarshal(bresp, &jresp); err != nil || jresp.Token.Token == "" {
+		return "", fmt.Errorf("failed to get token from login response of %s: %s", ts.url, bresp)
+	}
+	if jresp.Token.Timeout == 0 {
+		// the default timeout of BIG-IP tokens
+		jresp.Token.Timeout = 1200
+	}
+	ts.token = jresp.Token.Token
+	ts.expiry = start.Add(time.Duration(jresp.Token.Timeout) * time.Second)
+	return ts.token, nil
+}
@@ -0,0 +1,329 @@
+package cnisetup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
+	"gopkg.in/yaml.v3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	ciliumNamespace = "kube-system"
+	ciliumConfigMap = "cilium-config"
+	ciliumDaemonSet = "cilium"
+	ciliumAgent     = "cilium-agent"
+	// the default port of cilium vxlan tunnels
+	ciliumTunnelPort = 8472
+)
+
+// ciliumVtepSince is the first cilium release with the vtep integration.
+var ciliumVtepSince = [2]int{1, 12}
+
+// ciliumVtep is the vtep integration settings of cilium, each field is a space separated list
+// with one item per BIG-IP tunnel, except for mask which is shared by all.
+type ciliumVtep struct {
+	Endpoint []string
+	Cidr     []string
+	Mask     string
+	Mac      []string
+}
+
+// ciliumVtepOf combines the vtep settings from the tunnels of all the configs with cilium,
+// i.e. multiple BIG-IPs for the same cluster.
+func ciliumVtepOf(cs []*CNIConfig) (*ciliumVtep, error) {
+	vtep := ciliumVtep{}
+	for _, c := range cs {
+		for _, tunnel := range c.Cilium.Tunnels {
+			var cidr *net.IPNet
+			for _, selfip := range c.Cilium.SelfIPs {
+				if selfip.VlanOrTunnelName == tunnel.Name {
+					if _, ipnet, err := net.ParseCIDR(selfip.IpMask); err == nil {
+						cidr = ipnet
+						break
+					}
+				}
+			}
+			if cidr == nil {
+				return nil, fmt.Errorf("no self IP found for cilium tunnel %s of BIG-IP %s", tunnel.Name, c.Management.IpAddress)
+			}
+			mask := net.IP(cidr.Mask).String()
+			if vtep.Mask != "" && vtep.Mask != mask {
+				return nil, fmt.Errorf("cilium requires the same mask for all vteps, %s of tunnel %s differs from %s",
+					mask, tunnel.Name, vtep.Mask)
+			}
+			vtep.Mask = mask
+			if !strings.HasPrefix(tunnel.tunnelMac, "<") {
+				if err := checkUnicastMac(tunnel.tunnelMac); err != nil {
+					return nil, fmt.Errorf("invalid mac of cilium tunnel %s of BIG-IP %s: %s", tunnel.Name, c.Management.IpAddress, err.Error())
+				}
+			}
+			vtep.Endpoint = append(vtep.Endpoint, tunnel.LocalAddress)
+			vtep.Cidr = append(vtep.Cidr, cidr.String())
+			vtep.Mac = append(vtep.Mac, tunnel.tunnelMac)
+		}
+	}
+	return &vtep, nil
+}
+
+// ciliumValues is the helm values of cilium chart for the vtep integration.
+type ciliumValues struct {
+	Vtep struct {
+		Enabled  bool   `yaml:"enabled"`
+		Endpoint string `yaml:"endpoint,omitempty"`
+		Cidr     string `yaml:"cidr,omitempty"`
+		Mask     string `yaml:"mask,omitempty"`
+		Mac      string `yaml:"mac,omitempty"`
+	} `yaml:"vtep"`
+}
+
+func (vtep *ciliumVtep) values() ciliumValues {
+	values := ciliumValues{}
+	values.Vtep.Enabled = true
+	values.Vtep.Endpoint = strings.Join(vtep.Endpoint, " ")
+	values.Vtep.Cidr = strings.Join(vtep.Cidr, " ")
+	values.Vtep.Mask = vtep.Mask
+	values.Vtep.Mac = strings.Join(vtep.Mac, " ")
+	return values
+}
+
+func (vtep *ciliumVtep) data() map[string]interface{} {
+	return map[string]interface{}{
+		"enable-vtep":   "true",
+		"vtep-endpoint": strings.Join(vtep.Endpoint, " "),
+		"vtep-cidr":     strings.Join(vtep.Cidr, " "),
+		"vtep-mask":     vtep.Mask,
+		"vtep-mac":      strings.Join(vtep.Mac, " "),
+	}
+}
+
+// setupCiliumOnK8S patches the vtep settings of all BIG-IPs to cilium-config,
+// and restarts the cilium agents to take effect if any of them is changed,
+// or writes them as helm values if CiliumValuesFile is set.
+func (cnictx *CNIContext) setupCiliumOnK8S() error {
+	cs := cnictx.withCilium()
+	if len(cs) == 0 {
+		return nil
+	}
+	vtep, err := ciliumVtepOf(cs)
+	if err != nil {
+		return err
+	}
+	if err := cnictx.checkRunningCilium(cs, vtep); err != nil {
+		return err
+	}
+	if cnictx.CiliumValuesFile != "" {
+		return cnictx.writeCiliumValues(vtep.values())
+	}
+	return cnictx.patchCiliumConfig(cs[0].kubeConfig, vtep.data())
+}
+
+// teardownCiliumOnK8S disables the vtep integration in cilium-config, or in the helm values.
+func (cnictx *CNIContext) teardownCiliumOnK8S() error {
+	cs := cnictx.withCilium()
+	if len(cs) == 0 {
+		return nil
+	}
+	if cnictx.CiliumValuesFile != "" {
+		return cnictx.writeCiliumValues(ciliumValues{})
+	}
+	return cnictx.patchCiliumConfig(cs[0].kubeConfig, map[string]interface{}{
+		"enable-vtep":   "false",
+		"vtep-endpoint": nil,
+		"vtep-cidr":     nil,
+		"vtep-mask":     nil,
+		"vtep-mac":      nil,
+	})
+}
+
+// checkRunningCilium checks the running cilium can work with the vtep settings, see checkCiliumVtep.
+// With CiliumValuesFile, cilium may be not installed yet, and the settings not applied yet, which are warned only.
+func (cnictx *CNIContext) checkRunningCilium(cs []*CNIConfig, vtep *ciliumVtep) error {
+	slog := utils.LogFromContext(cnictx)
+	k8sclient, err := kubeClientOf(cs[0].kubeConfig)
+	if err != nil {
+		return err
+	}
+	cm, err := k8sclient.CoreV1().ConfigMaps(ciliumNamespace).Get(context.TODO(), ciliumConfigMap, metav1.GetOptions{})
+	if err != nil && cnictx.CiliumValuesFile != "" && k8serrors.IsNotFound(err) {
+		slog.Warnf("%s/%s not found, the vtep settings are not checked against the running cilium", ciliumNamespace, ciliumConfigMap)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get %s/%s, is cilium installed? %s", ciliumNamespace, ciliumConfigMap, err.Error())
+	}
+	ds, err := k8sclient.AppsV1().DaemonSets(ciliumNamespace).Get(context.TODO(), ciliumDaemonSet, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s/%s for the version of cilium: %s", ciliumNamespace, ciliumDaemonSet, err.Error())
+	}
+	image := ""
+	for _, container := range ds.Spec.Template.Spec.Containers {
+		if container.Name == ciliumAgent {
+			image = container.Image
+		}
+	}
+	if err := checkCiliumVtep(cm.Data, image, cs); err != nil {
+		return err
+	}
+
+	if cnictx.CiliumValuesFile != "" {
+		for k, v := range vtep.data() {
+			if cm.Data[k] != v {
+				slog.Warnf("%s of the running cilium is '%s', not '%s' as in %s yet", k, cm.Data[k], v, cnictx.CiliumValuesFile)
+			}
+		}
+	}
+	return nil
+}
+
+// checkCiliumVtep checks the cilium config and the agent image against the vtep integration with BIG-IP tunnels:
+// a cilium release with the integration, in vxlan tunnel mode on the same port as the BIG-IP tunnels.
+// Cilium sends the traffic to the vtep MACs, i.e. the tunnel MACs of BIG-IP, and routes the traffic from BIG-IP
+// by the inner IP, so that the node MACs in the fdb records only need to be unicast and distinct, see checkCiliumMacs.
+func checkCiliumVtep(data map[string]string, image string, cs []*CNIConfig) error {
+	if version, ok := ciliumVersionOf(image); ok && (version[0] < ciliumVtepSince[0] ||
+		version[0] == ciliumVtepSince[0] && version[1] < ciliumVtepSince[1]) {
+		return fmt.Errorf("cilium %d.%d of image %s has no vtep integration, which requires %d.%d or later",
+			version[0], version[1], image, ciliumVtepSince[0], ciliumVtepSince[1])
+	}
+
+	// tunnel is replaced by routing-mode and tunnel-protocol since cilium 1.14.
+	protocol := data["tunnel-protocol"]
+	if protocol == "" {
+		protocol = data["tunnel"]
+	}
+	if data["routing-mode"] == "native" || protocol == "disabled" {
+		return fmt.Errorf("cilium is in native routing mode, the vtep integration requires vxlan tunnel mode")
+	}
+	if protocol != "" && protocol != "vxlan" {
+		return fmt.Errorf("cilium tunnel protocol is %s, the vtep integration requires vxlan", protocol)
+	}
+
+	port := ciliumTunnelPort
+	if p, ok := data["tunnel-port"]; ok && p != "" && p != "0" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid tunnel-port '%s' in %s/%s", p, ciliumNamespace, ciliumConfigMap)
+		}
+		port = n
+	}
+	for _, c := range cs {
+		for _, tunnel := range c.Cilium.Tunnels {
+			if tunnel.Port != port {
+				return fmt.Errorf("port %d of cilium tunnel %s of BIG-IP %s differs from the cilium tunnel port %d",
+					tunnel.Port, tunnel.Name, c.Management.IpAddress, port)
+			}
+		}
+	}
+	return nil
+}
+
+// ciliumVersionOf returns the major and minor version in the image tag, i.e. quay.io/cilium/cilium:v1.14.2@sha256:...
+func ciliumVersionOf(image string) ([2]int, bool) {
+	image = strings.Split(image, "@")[0]
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return [2]int{}, false
+	}
+	m := regexp.MustCompile(`^v?(\d+)\.(\d+)`).FindStringSubmatch(image[i+1:])
+	if m == nil {
+		return [2]int{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return [2]int{major, minor}, true
+}
+
+func (cnictx *CNIContext) withCilium() []*CNIConfig {
+	cs := []*CNIConfig{}
+	for i, c := range cnictx.CNIConfigs {
+		if c.Cilium != nil {
+			cs = append(cs, &cnictx.CNIConfigs[i])
+		}
+	}
+	return cs
+}
+
+func (cnictx *CNIContext) patchCiliumConfig(kubeConfig string, data map[string]interface{}) error {
+	slog := utils.LogFromContext(cnictx)
+	k8sclient, err := kubeClientOf(kubeConfig)
+	if err != nil {
+		return err
+	}
+
+	cm, err := k8sclient.CoreV1().ConfigMaps(ciliumNamespace).Get(context.TODO(), ciliumConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s/%s, is cilium installed? %s", ciliumNamespace, ciliumConfigMap, err.Error())
+	}
+	changed := false
+	for k, v := range data {
+		ov, found := cm.Data[k]
+		if (v == nil && found) || (v != nil && ov != v.(string)) {
+			changed = true
+		}
+	}
+	if !changed {
+		slog.Infof("vtep settings in %s/%s are up to date", ciliumNamespace, ciliumConfigMap)
+		return nil
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{"data": data})
+	cmName := ciliumNamespace + "/" + ciliumConfigMap
+	cnictx.recordK8SOperation("patch", "ConfigMap", cmName, data)
+	patchOps := metav1.PatchOptions{DryRun: cnictx.dryRun()}
+	if _, err := k8sclient.CoreV1().ConfigMaps(ciliumNamespace).Patch(context.TODO(), ciliumConfigMap, types.MergePatchType, patch, patchOps); err != nil {
+		return err
+	}
+	slog.Infof("vtep settings patched to %s", cmName)
+
+	// the same as 'kubectl rollout restart', for cilium agents read the config at startup only.
+	restart := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						"kubectl.kubernetes.io/restartedAt": time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	}
+	patch, _ = json.Marshal(restart)
+	dsName := ciliumNamespace + "/" + ciliumDaemonSet
+	cnictx.recordK8SOperation("patch", "DaemonSet", dsName, restart)
+	if _, err := k8sclient.AppsV1().DaemonSets(ciliumNamespace).Patch(context.TODO(), ciliumDaemonSet, types.StrategicMergePatchType, patch, patchOps); err != nil {
+		return fmt.Errorf("failed to restart %s: %s", dsName, err.Error())
+	}
+	slog.Infof("rollout of %s triggered", dsName)
+	return nil
+}
+
+// writeCiliumValues writes the helm values to CiliumValuesFile, to be merged into the values of cilium release,
+// i.e. 'helm upgrade cilium cilium/cilium --reuse-values -f <file>'.
+func (cnictx *CNIContext) writeCiliumValues(values ciliumValues) error {
+	slog := utils.LogFromContext(cnictx)
+	bvalues, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if cnictx.Plan != nil {
+		cnictx.recordK8SOperation("write", "HelmValues", cnictx.CiliumValuesFile, values)
+		return nil
+	}
+	header := "# generated by setup-cni, the vtep settings of BIG-IPs for cilium helm chart\n"
+	if err := os.WriteFile(cnictx.CiliumValuesFile, append([]byte(header), bvalues...), 0644); err != nil {
+		return fmt.Errorf("failed to write cilium helm values: %s", err.Error())
+	}
+	slog.Infof("cilium helm values written to %s", cnictx.CiliumValuesFile)
+	return nil
+}
@@ -0,0 +1,129 @@
+package cnisetup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const ciliumConfig = `management:
+  ipAddress: 10.250.2.219
+cilium:
+  tunnels:
+    - name: fl-tunnel
+      profileName: fl-vxlan
+      port: 8472
+      localAddress: 10.250.16.105
+  selfIPs:
+    - name: flannel-self
+      ipMask: 10.0.20.1/24
+      vlanOrTunnelName: fl-tunnel
+`
+
+func TestCheckCiliumVtep(t *testing.T) {
+	cs := []*CNIConfig{configOf(t, ciliumConfig)}
+	cases := []struct {
+		name  string
+		data  map[string]string
+		image string
+		err   string
+	}{
+		{name: "defaults", data: map[string]string{}, image: "quay.io/cilium/cilium:v1.12.0"},
+		{name: "unknown version", data: map[string]string{}, image: "localhost:5000/cilium/cilium"},
+		{name: "legacy vxlan", data: map[string]string{"tunnel": "vxlan"}, image: "quay.io/cilium/cilium:v1.13.4@sha256:0123"},
+		{name: "tunnel mode", data: map[string]string{"routing-mode": "tunnel", "tunnel-protocol": "vxlan", "tunnel-port": "8472"},
+			image: "quay.io/cilium/cilium:v1.14.2"},
+		{name: "old version", data: map[string]string{}, image: "quay.io/cilium/cilium:v1.11.9", err: "has no vtep integration"},
+		{name: "native routing", data: map[string]string{"routing-mode": "native"}, image: "cilium:v1.14.2", err: "native routing mode"},
+		{name: "legacy native routing", data: map[string]string{"tunnel": "disabled"}, image: "cilium:v1.12.0", err: "native routing mode"},
+		{name: "geneve", data: map[string]string{"tunnel-protocol": "geneve"}, image: "cilium:v1.14.2", err: "requires vxlan"},
+		{name: "port mismatch", data: map[string]string{"tunnel-port": "4789"}, image: "cilium:v1.14.2", err: "differs from the cilium tunnel port 4789"},
+		{name: "invalid port", data: map[string]string{"tunnel-port": "vxlan"}, image: "cilium:v1.14.2", err: "invalid tunnel-port"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkCiliumVtep(tc.data, tc.image, cs)
+			if tc.err == "" && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("got error %v, want '%s'", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCiliumVtepOf(t *testing.T) {
+	// the second BIG-IP of the same cluster.
+	second := strings.NewReplacer("10.250.2.219", "10.250.2.220", "10.250.16.105", "10.250.16.106", "10.0.20.1/24", "10.0.21.1/24").Replace(ciliumConfig)
+	cases := []struct {
+		name    string
+		configs []string
+		macs    []string
+		want    *ciliumVtep
+		err     string
+	}{
+		{
+			name:    "one BIG-IP",
+			configs: []string{ciliumConfig},
+			macs:    []string{"00:50:56:86:6e:b4"},
+			want: &ciliumVtep{Endpoint: []string{"10.250.16.105"}, Cidr: []string{"10.0.20.0/24"},
+				Mask: "255.255.255.0", Mac: []string{"00:50:56:86:6e:b4"}},
+		},
+		{
+			name:    "macs in the order of BIG-IPs",
+			configs: []string{second, ciliumConfig},
+			macs:    []string{"00:50:56:86:6e:b6", "00:50:56:86:6e:b4"},
+			want: &ciliumVtep{Endpoint: []string{"10.250.16.106", "10.250.16.105"}, Cidr: []string{"10.0.21.0/24", "10.0.20.0/24"},
+				Mask: "255.255.255.0", Mac: []string{"00:50:56:86:6e:b6", "00:50:56:86:6e:b4"}},
+		},
+		{
+			name:    "placeholder mac in dry-run",
+			configs: []string{ciliumConfig},
+			macs:    []string{"<mac of tunnel fl-tunnel>"},
+			want: &ciliumVtep{Endpoint: []string{"10.250.16.105"}, Cidr: []string{"10.0.20.0/24"},
+				Mask: "255.255.255.0", Mac: []string{"<mac of tunnel fl-tunnel>"}},
+		},
+		{
+			name:    "mask mismatch",
+			configs: []string{ciliumConfig, strings.Replace(second, "10.0.21.1/24", "10.1.0.1/16", 1)},
+			macs:    []string{"00:50:56:86:6e:b4", "00:50:56:86:6e:b6"},
+			err:     "255.255.0.0 of tunnel fl-tunnel differs from 255.255.255.0",
+		},
+		{
+			name:    "missing self IP",
+			configs: []string{strings.Replace(ciliumConfig, "vlanOrTunnelName: fl-tunnel", "vlanOrTunnelName: vlan-16", 1)},
+			macs:    []string{"00:50:56:86:6e:b4"},
+			err:     "no self IP found for cilium tunnel fl-tunnel of BIG-IP 10.250.2.219",
+		},
+		{
+			name:    "multicast mac",
+			configs: []string{ciliumConfig},
+			macs:    []string{"01:50:56:86:6e:b4"},
+			err:     "invalid mac of cilium tunnel fl-tunnel",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := []*CNIConfig{}
+			for i, content := range tc.configs {
+				c := configOf(t, content)
+				c.Cilium.Tunnels[0].tunnelMac = tc.macs[i]
+				cs = append(cs, c)
+			}
+			vtep, err := ciliumVtepOf(cs)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("got error %v, want '%s'", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(vtep, tc.want) {
+				t.Errorf("got %+v, want %+v", vtep, tc.want)
+			}
+		})
+	}
+}
@@ -4,18 +4,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 
-	f5_bigip "github.com/f5devcentral/f5-bigip-rest-go/bigip"
-	"github.com/f5devcentral/f5-bigip-rest-go/utils"
+	f5_bigip "f5-tool-setup-cni/third_party/f5-bigip-rest-go/bigip"
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	confv1 "k8s.io/client-go/applyconfigurations/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 func (cniconfs *CNIConfigs) Load(configPath, passwordPath, kubeConfigPath string) error {
@@ -23,22 +32,79 @@ func (cniconfs *CNIConfigs) Load(configPath, passwordPath, kubeConfigPath string
 		return err
 	}
 
-	var password string
-	if err := getCredentials(&password, passwordPath); err != nil {
-		return err
-	}
-
 	for i := range *cniconfs {
 		defaultPort := 443
-		(*cniconfs)[i].Management.password = password
 		if (*cniconfs)[i].Management.Port == nil {
 			(*cniconfs)[i].Management.Port = &defaultPort
 		}
 		(*cniconfs)[i].kubeConfig = kubeConfigPath
+		if err := (*cniconfs)[i].loadCredentials(passwordPath); err != nil {
+			return err
+		}
+		if err := (*cniconfs)[i].loadBGPPassword(); err != nil {
+			return err
+		}
+	}
+
+	// the entries of the same BIG-IP and partition share the connection and the token of the first one.
+	for _, cs := range cniconfs.byBIGIP() {
+		conn, err := cs[0].connection()
+		if err != nil {
+			return err
+		}
+		for _, c := range cs[1:] {
+			c.conn = conn
+		}
 	}
 	return nil
 }
 
+// loadCredentials gets the password from the source configured in management,
+// or from the passwordPath file shared by all BIG-IPs if none configured.
+func (cniconf *CNIConfig) loadCredentials(passwordPath string) error {
+	mgmt := &cniconf.Management
+	var username, password string
+	var err error
+	switch {
+	case mgmt.PasswordFile != "":
+		err = getCredentials(&password, mgmt.PasswordFile)
+	case mgmt.PasswordEnv != "":
+		if v, ok := os.LookupEnv(mgmt.PasswordEnv); ok {
+			password = strings.TrimSpace(v)
+		} else {
+			err = fmt.Errorf("environment variable %s is not set", mgmt.PasswordEnv)
+		}
+	case mgmt.SecretRef != nil:
+		username, password, err = getSecretCredentials(cniconf.kubeConfig, mgmt.SecretRef)
+	default:
+		err = getCredentials(&password, passwordPath)
+	}
+	if err == nil && password == "" {
+		err = fmt.Errorf("the password is empty")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get credentials of BIG-IP %s: %s", mgmt.IpAddress, err.Error())
+	}
+	cniconf.setCredentials(username, password)
+	return nil
+}
+
+// loadBGPPassword reads the bgp password of calico from the Secret, if configured.
+func (cniconf *CNIConfig) loadBGPPassword() error {
+	if cniconf.Calico == nil || cniconf.Calico.PasswordSecretRef == nil {
+		return nil
+	}
+	_, password, err := getSecretCredentials(cniconf.kubeConfig, cniconf.Calico.PasswordSecretRef)
+	if err == nil && password == "" {
+		err = fmt.Errorf("the password is empty")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get bgp password for BIG-IP %s: %s", cniconf.Management.IpAddress, err.Error())
+	}
+	cniconf.Calico.bgpPassword = password
+	return nil
+}
+
 func (cnictx *CNIContext) Dumps() string {
 	slog := utils.LogFromContext(cnictx.Context)
 	// fmt.Printf("%#v\n", config)
@@ -61,6 +127,19 @@ func (cnictx *CNIContext) Apply() error {
 	return nil
 }
 
+// Delete removes everything Apply and HandleNodeChanges created, computed from the
+// same configuration: the kubernetes resources first, then the BIG-IP objects.
+func (cnictx *CNIContext) Delete() error {
+	if err := cnictx.deleteFromK8S(); err != nil {
+		return err
+	}
+
+	if err := cnictx.deleteFromBIGIPs(); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (cnictx *CNIContext) OnTrace(mgr manager.Manager, loglevel string) error {
 	rNode := &NodeReconciler{
 		Client:     mgr.GetClient(),
@@ -68,68 +147,243 @@ func (cnictx *CNIContext) OnTrace(mgr manager.Manager, loglevel string) error {
 		LogLevel:   loglevel,
 		CNIConfigs: &cnictx.CNIConfigs,
 	}
-	err := ctrl.NewControllerManagedBy(mgr).For(&v1.Node{}).Complete(rNode)
+	// the other controllers request node syncs via resyncs, so that they never run concurrently with NodeReconciler.
+	resyncs := make(chan event.GenericEvent, 1)
+	nodeHandler := nodeEventHandler(cnictx.NodeDebounce, loglevel)
+	err := ctrl.NewControllerManagedBy(mgr).
+		Named("node").
+		Watches(&source.Kind{Type: &v1.Node{}}, nodeHandler, builder.WithPredicates(nodePredicate)).
+		Watches(&source.Channel{Source: resyncs}, nodeHandler).
+		Complete(rNode)
 	if err != nil {
 		return err
 	}
+
+	// watch the secrets for credential rotation only if any referred.
+	referred := func(obj client.Object) bool {
+		return len(cnictx.CNIConfigs.referringTo(obj.GetNamespace(), obj.GetName())) > 0
+	}
+	if len(cnictx.CNIConfigs.withSecretRef()) > 0 {
+		rSecret := &SecretReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			LogLevel:   loglevel,
+			CNIConfigs: &cnictx.CNIConfigs,
+			Resyncs:    resyncs,
+		}
+		err = ctrl.NewControllerManagedBy(mgr).
+			For(&v1.Secret{}, builder.WithPredicates(predicate.NewPredicateFuncs(referred))).
+			Complete(rSecret)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (cnictx *CNIContext) applyToBIGIPs() error {
 	errs := []error{}
-	ncfgs := map[string]interface{}{}
-	for _, c := range cnictx.CNIConfigs {
-		bigip := f5_bigip.New(c.bigipUrl(), c.Management.Username, c.Management.password)
-		bc := &f5_bigip.BIGIPContext{BIGIP: *bigip, Context: context.TODO()}
+	for _, cs := range cnictx.CNIConfigs.byBIGIP() {
+		bc, err := cs[0].newBIGIPContext(cnictx.Context)
+		if err != nil {
+			return err
+		}
 
-		if c.Calico != nil {
-			if err := enableBGPRouting(bc); err != nil {
-				return err
+		ncfgs := map[string]interface{}{}
+		for _, c := range cs {
+			if c.Calico != nil {
+				if err := cnictx.enableBGPRouting(bc, c.routeDomain()); err != nil {
+					return err
+				}
+				calicoCfgs := c.parseCalicoConfig()
+				for k, v := range calicoCfgs {
+					ncfgs[k] = v
+				}
+			}
+
+			if c.Flannel != nil {
+				flannelCfgs := c.parseFlannelConfig()
+				for k, v := range flannelCfgs {
+					ncfgs[k] = v
+				}
 			}
-			calicoCfgs := c.parseCalicoConfig()
-			for k, v := range calicoCfgs {
-				ncfgs[k] = v
+
+			if c.Cilium != nil {
+				ciliumCfgs := c.parseCiliumConfig()
+				for k, v := range ciliumCfgs {
+					ncfgs[k] = v
+				}
 			}
 		}
+		errs = append(errs, cnictx.converge(bc, cs[0].partition(), stateKeyConfig, &map[string]interface{}{"": ncfgs}))
+	}
 
-		if c.Flannel != nil {
-			flannelCfgs := c.parseFlannelConfig()
-			for k, v := range flannelCfgs {
-				ncfgs[k] = v
+	err := cnictx.setTunnelMacs()
+	return utils.MergeErrors(append(errs, err))
+}
+
+func (cnictx *CNIContext) deleteFromBIGIPs() error {
+	slog := utils.LogFromContext(cnictx)
+	errs := []error{}
+	// the routing state is device-wide, restored after the bgp instances of all partitions on the BIG-IP are deleted.
+	routings := map[string]*f5_bigip.BIGIPContext{}
+	deletedBGPs := map[string]bool{}
+	// the partitions created by this tool are deleted at last, if empty after uninstalling all their entries.
+	bcs := map[string]*f5_bigip.BIGIPContext{}
+	uninstalled := map[string]map[string]bool{}
+	for _, cs := range cnictx.CNIConfigs.byBIGIP() {
+		bc, err := cs[0].newBIGIPContext(cnictx.Context)
+		if err != nil {
+			return err
+		}
+
+		partition := cs[0].partition()
+		ocfgs := map[string]interface{}{}
+		// the last applied configs cover the objects already removed from the configuration file.
+		for _, key := range []string{stateKeyConfig, stateKeyNodes} {
+			lastApplied, err := loadLastApplied(bc, stateKeyOf(key, partition))
+			if err != nil {
+				return err
+			}
+			if lastApplied != nil {
+				if cfgs, ok := (*lastApplied)[""].(map[string]interface{}); ok {
+					for k, v := range cfgs {
+						ocfgs[k] = v
+					}
+				}
 			}
 		}
+		for _, c := range cs {
+			if c.Calico != nil {
+				for k, v := range c.parseCalicoConfig() {
+					ocfgs[k] = v
+				}
+			}
+			if c.Flannel != nil {
+				for k, v := range c.parseFlannelConfig() {
+					ocfgs[k] = v
+				}
+			}
+			if c.Cilium != nil {
+				for k, v := range c.parseCiliumConfig() {
+					ocfgs[k] = v
+				}
+			}
 
-		if c.Cilium != nil {
-			ciliumCfgs := c.parseCiliumConfig()
-			for k, v := range ciliumCfgs {
-				ncfgs[k] = v
+			// with no nodes, only the bgp instance and the fdb tunnels are generated.
+			ncfgs, err := parseNodeConfigs(cnictx.Context, c, &v1.NodeList{}, "")
+			if err != nil {
+				return err
+			}
+			for k, v := range ncfgs[""].(map[string]interface{}) {
+				ocfgs[k] = v
+			}
+		}
+		for k := range ocfgs {
+			// fdb tunnels cannot be deleted directly, they go away with the tunnels.
+			if strings.HasPrefix(k, "net/fdb/tunnel/") {
+				delete(ocfgs, k)
+			}
+		}
+		if err := cnictx.deploy(bc, partition, &map[string]interface{}{"": ocfgs}, nil); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cnictx.Plan == nil {
+			for _, key := range []string{stateKeyConfig, stateKeyNodes} {
+				errs = append(errs, bc.DeleteDataGroup(stateKeyOf(key, partition)))
+			}
+		}
+		if _, ok := uninstalled[bc.URL]; !ok {
+			bcs[bc.URL], uninstalled[bc.URL] = bc, map[string]bool{}
+		}
+		uninstalled[bc.URL][partition] = true
+		for k := range ocfgs {
+			if strings.HasPrefix(k, "net/routing/bgp/") {
+				name := strings.TrimPrefix(k, "net/routing/bgp/")
+				deletedBGPs[bc.URL+utils.Refname(partition, "", name)] = true
+			}
+		}
+		for _, c := range cs {
+			if c.Calico != nil {
+				routings[bc.URL] = bc
+				break
 			}
 		}
-		errs = append(errs, deploy(bc, "Common", nil, &map[string]interface{}{"": ncfgs}))
 	}
 
-	err := cnictx.setTunnelMacs()
-	return utils.MergeErrors(append(errs, err))
+	urls := []string{}
+	for url := range routings {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		bc := routings[url]
+		// in dry-run mode, the deleted ones are still there.
+		remaining, err := bgpInstancesOf(bc, func(fullPath string) bool { return !deletedBGPs[url+fullPath] })
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(remaining) > 0 {
+			slog.Infof("routing state of BIG-IP %s is kept for the remaining bgp instances: %s", url, strings.Join(remaining, ", "))
+			continue
+		}
+		errs = append(errs, cnictx.restoreBGPRouting(bc))
+	}
+
+	urls = []string{}
+	for url := range bcs {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		errs = append(errs, cnictx.deletePartitions(bcs[url], uninstalled[url]))
+	}
+
+	return utils.MergeErrors(errs)
 }
 
 func (cnictx *CNIContext) setTunnelMacs() error {
-	for _, c := range cnictx.CNIConfigs {
-		bigip := f5_bigip.New(c.bigipUrl(), c.Management.Username, c.Management.password)
-		bc := &f5_bigip.BIGIPContext{BIGIP: *bigip, Context: context.TODO()}
-		if c.Flannel == nil {
+	for i := range cnictx.CNIConfigs {
+		c := &cnictx.CNIConfigs[i]
+		if c.Flannel == nil && c.Cilium == nil {
 			continue
 		}
-		for i, tunnel := range c.Flannel.Tunnels {
-			if mac, err := macAddrOfTunnel(bc, tunnel.Name); err != nil {
-				return err
-			} else {
-				c.Flannel.Tunnels[i].tunnelMac = mac
+		bc, err := c.newBIGIPContext(context.TODO())
+		if err != nil {
+			return err
+		}
+		if c.Flannel != nil {
+			for i, tunnel := range c.Flannel.Tunnels {
+				if c.Flannel.Tunnels[i].tunnelMac, err = cnictx.tunnelMacOf(bc, c.partition(), tunnel.Name); err != nil {
+					return err
+				}
+			}
+		}
+		if c.Cilium != nil {
+			for i, tunnel := range c.Cilium.Tunnels {
+				if c.Cilium.Tunnels[i].tunnelMac, err = cnictx.tunnelMacOf(bc, c.partition(), tunnel.Name); err != nil {
+					return err
+				}
 			}
 		}
 	}
 	return nil
 }
 
+func (cnictx *CNIContext) tunnelMacOf(bc *f5_bigip.BIGIPContext, partition, name string) (string, error) {
+	if cnictx.Plan != nil {
+		// the tunnel may not be created yet in dry-run mode, the other errors are still reported.
+		if exists, err := bc.Exist("net/tunnels/tunnel", name, partition, ""); err != nil {
+			return "", countRestError(bc, "net/tunnels/tunnel", err)
+		} else if exists == nil {
+			return fmt.Sprintf("<mac of tunnel %s>", name), nil
+		}
+	}
+	return macAddrOfTunnel(bc, partition, name)
+}
+
 func (cnictx *CNIContext) applyToK8S() error {
 	for _, cniconf := range cnictx.CNIConfigs {
 		if cniconf.Calico != nil {
@@ -142,37 +396,180 @@ func (cnictx *CNIContext) applyToK8S() error {
 				return err
 			}
 		}
-		if cniconf.Cilium != nil {
-			if err := cniconf.setupCiliumOnK8S(cnictx); err != nil {
+	}
+	return cnictx.setupCiliumOnK8S()
+}
+
+func (cnictx *CNIContext) deleteFromK8S() error {
+	for _, cniconf := range cnictx.CNIConfigs {
+		if cniconf.Calico != nil {
+			if err := cniconf.teardownCalicoOnK8S(cnictx); err != nil {
+				return err
+			}
+		}
+		if cniconf.Flannel != nil {
+			if err := cniconf.teardownFlannelOnK8S(cnictx); err != nil {
 				return err
 			}
 		}
 	}
+	return cnictx.teardownCiliumOnK8S()
+}
+
+// dryRun returns the DryRun option for k8s requests, so that k8s validates but does not persist them in dry-run mode.
+func (cnictx *CNIContext) dryRun() []string {
+	if cnictx.Plan != nil {
+		return []string{metav1.DryRunAll}
+	}
 	return nil
 }
 
+func (cnictx *CNIContext) recordK8SOperation(operation, kind, name string, object interface{}) {
+	if cnictx.Plan != nil {
+		cnictx.Plan.addK8SOperation(operation, kind, name, object)
+	}
+}
+
 func (cniconf *CNIConfig) macAddrOf(publicIP string) (string, error) {
 	if cniconf.Flannel == nil {
 		return "", fmt.Errorf("bigip config flannel is nil")
 	}
 	for _, tunnel := range cniconf.Flannel.Tunnels {
-		if tunnel.LocalAddress == publicIP {
+		if normalizedIP(tunnel.LocalAddress) == normalizedIP(publicIP) {
 			return tunnel.tunnelMac, nil
 		}
 	}
 	return "", fmt.Errorf("no tunnel with IP address '%s' found in the config", publicIP)
 }
 
+// bgpPeers returns the specs of BGPPeers by name, one for each of peerIPs, and one more for
+// peerSelector if set, so that the nodes not peering with BIG-IP learn the routes from the selected ones.
+func (cniconf *CNIConfig) bgpPeers(localAS int64) map[string]map[string]interface{} {
+	peers := map[string]map[string]interface{}{}
+	for _, prIP := range cniconf.Calico.PeerIPs {
+		spec := map[string]interface{}{
+			"asNumber": localAS,
+			"peerIP":   prIP,
+		}
+		if cniconf.Calico.NodeSelector != "" {
+			spec["nodeSelector"] = cniconf.Calico.NodeSelector
+		}
+		if ref := cniconf.Calico.PasswordSecretRef; ref != nil {
+			// calico reads the Secret in its own namespace.
+			key := ref.PasswordKey
+			if key == "" {
+				key = "password"
+			}
+			spec["password"] = map[string]interface{}{
+				"secretKeyRef": map[string]interface{}{"name": ref.Name, "key": key},
+			}
+		}
+		if gr := cniconf.Calico.GracefulRestart; gr != nil && gr.RestartTime > 0 {
+			spec["maxRestartTime"] = fmt.Sprintf("%ds", gr.RestartTime)
+		}
+		peers[bgpPeerNameOf(prIP)] = spec
+	}
+	if cniconf.Calico.PeerSelector != "" {
+		peers["bgppeer-bigip-peer-selector"] = map[string]interface{}{
+			"nodeSelector": "all()",
+			"peerSelector": cniconf.Calico.PeerSelector,
+		}
+	}
+	return peers
+}
+
+// bgpPeerNameOf returns the name of the BGPPeer for the BIG-IP address,
+// i.e. bgppeer-bigip-10.250.17.220, or bgppeer-bigip-2001-db8--220 for IPv6.
+func bgpPeerNameOf(peerIP string) string {
+	return fmt.Sprintf("bgppeer-bigip-%s", dnsLabelOf(peerIP))
+}
+
+// nodeName returns the name of the virtual node, i.e. bigip-10.250.17.219, or bigip-2001-db8--219
+// for IPv6 only, since colons are not allowed in node names.
+func (nc *FlannelNodeConfig) nodeName() string {
+	if nc.PublicIP != "" {
+		return fmt.Sprintf("bigip-%s", dnsLabelOf(nc.PublicIP))
+	}
+	return fmt.Sprintf("bigip-%s", dnsLabelOf(nc.PublicIPv6))
+}
+
+// byBIGIP groups the configurations by BIG-IP and partition in the order of appearance,
+// for multiple entries may target the same BIG-IP with different CNIs.
+func (cniconfs CNIConfigs) byBIGIP() [][]*CNIConfig {
+	groups := [][]*CNIConfig{}
+	indexes := map[string]int{}
+	for i := range cniconfs {
+		key := cniconfs[i].bigipUrl() + "/" + cniconfs[i].partition()
+		if idx, ok := indexes[key]; ok {
+			groups[idx] = append(groups[idx], &cniconfs[i])
+		} else {
+			indexes[key] = len(groups)
+			groups = append(groups, []*CNIConfig{&cniconfs[i]})
+		}
+	}
+	return groups
+}
+
+func (cniconf *CNIConfig) partition() string {
+	if cniconf.Partition == "" {
+		return "Common"
+	}
+	return cniconf.Partition
+}
+
+func (cniconf *CNIConfig) routeDomain() int {
+	if cniconf.RouteDomain == nil {
+		return 0
+	}
+	return *cniconf.RouteDomain
+}
+
+func (cniconf *CNIConfig) bgpRouterName() string {
+	if cniconf.BgpRouterName == "" {
+		return "gwcBGP"
+	}
+	return cniconf.BgpRouterName
+}
+
+func (cniconf *CNIConfig) credentials() (string, string) {
+	credentialsLock.RLock()
+	defer credentialsLock.RUnlock()
+	return cniconf.Management.Username, cniconf.Management.password
+}
+
+// setCredentials updates the credentials, it returns true if they are changed.
+func (cniconf *CNIConfig) setCredentials(username, password string) bool {
+	credentialsLock.Lock()
+	if username == "" {
+		username = cniconf.Management.Username
+	}
+	changed := username != cniconf.Management.Username || password != cniconf.Management.password
+	cniconf.Management.Username, cniconf.Management.password = username, password
+	credentialsLock.Unlock()
+
+	// out of credentialsLock, for the token login reads the credentials with the session locked.
+	connsLock.Lock()
+	conn := cniconf.conn
+	connsLock.Unlock()
+	if changed && conn != nil && conn.session != nil {
+		conn.session.Invalidate()
+	}
+	return changed
+}
+
 func (cniconf *CNIConfig) bigipUrl() string {
-	return fmt.Sprintf("https://%s:%d", cniconf.Management.IpAddress, *cniconf.Management.Port)
+	return "https://" + net.JoinHostPort(normalizedIP(cniconf.Management.IpAddress), strconv.Itoa(*cniconf.Management.Port))
 }
 
-func (cniconf *CNIConfig) setupCalicoOnK8S(ctx context.Context) error {
-	slog := utils.LogFromContext(ctx)
-	calicoset := newCalicoClient(cniconf.kubeConfig)
+func (cniconf *CNIConfig) setupCalicoOnK8S(cnictx *CNIContext) error {
+	slog := utils.LogFromContext(cnictx)
+	calicoset, err := calicoClientOf(cniconf.kubeConfig)
+	if err != nil {
+		return err
+	}
 
 	group, version := "crd.projectcalico.org", "v1"
-	applyOps := metav1.ApplyOptions{FieldManager: strings.Join([]string{group, version}, "/")}
+	applyOps := metav1.ApplyOptions{FieldManager: strings.Join([]string{group, version}, "/"), DryRun: cnictx.dryRun()}
 
 	gvrBGPConf := schema.GroupVersionResource{
 		Group:    group,
@@ -185,20 +582,40 @@ func (cniconf *CNIConfig) setupCalicoOnK8S(ctx context.Context) error {
 		return fmt.Errorf("failed to parse as number from input: %v %v", err1, err2)
 	}
 	bgpConfName := "default"
+	// only the fields set here are owned, the others, i.e. route reflectors and communities, are left as they are.
+	spec := map[string]interface{}{
+		"asNumber": remoteAS,
+	}
+	if cniconf.Calico.NodeToNodeMesh != nil {
+		spec["nodeToNodeMeshEnabled"] = *cniconf.Calico.NodeToNodeMesh
+	}
+	for field, cidrs := range map[string][]string{
+		"serviceClusterIPs":      cniconf.Calico.ServiceClusterIPs,
+		"serviceExternalIPs":     cniconf.Calico.ServiceExternalIPs,
+		"serviceLoadBalancerIPs": cniconf.Calico.ServiceLoadBalancerIPs,
+	} {
+		if len(cidrs) > 0 {
+			items := []interface{}{}
+			for _, cidr := range cidrs {
+				items = append(items, map[string]interface{}{"cidr": cidr})
+			}
+			spec[field] = items
+		}
+	}
 	confyaml := unstructured.Unstructured{
 		Object: map[string]interface{}{
 			"apiVersion": strings.Join([]string{group, version}, "/"),
 			"kind":       "BGPConfiguration",
 			"metadata":   map[string]interface{}{"name": bgpConfName},
-			"spec": map[string]interface{}{
-				"asNumber":              remoteAS,
-				"logSeverityScreen":     "Info",
-				"nodeToNodeMeshEnabled": true,
-			},
+			"spec":       spec,
 		},
 	}
+	cnictx.recordK8SOperation("apply", "BGPConfiguration", bgpConfName, confyaml.Object)
 	applyedConf, err := calicoset.Resource(gvrBGPConf).Apply(context.TODO(), bgpConfName, &confyaml, applyOps)
-	if err != nil {
+	if k8serrors.IsConflict(err) {
+		return fmt.Errorf("BGPConfiguration %s has different values set by other managers, "+
+			"align the calico settings with them or unset them in the configuration: %s", bgpConfName, err.Error())
+	} else if err != nil {
 		return err
 	} else {
 		slog.Infof("successfully applied BGPConfiguration: %s", applyedConf.GetName())
@@ -210,23 +627,28 @@ func (cniconf *CNIConfig) setupCalicoOnK8S(ctx context.Context) error {
 		Resource: "bgppeers",
 	}
 
-	for _, prIP := range cniconf.Calico.PeerIPs {
-		bgpPeerName := fmt.Sprintf("bgppeer-bigip-%s", prIP)
+	peers := cniconf.bgpPeers(localAS)
+	names := []string{}
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, bgpPeerName := range names {
+		spec := peers[bgpPeerName]
 		pryaml := unstructured.Unstructured{
 			Object: map[string]interface{}{
 				"apiVersion": strings.Join([]string{group, version}, "/"),
 				"kind":       "BGPPeer",
 				"metadata": map[string]interface{}{
-					"name": bgpPeerName,
+					"name":   bgpPeerName,
+					"labels": map[string]interface{}{labelManagedBy: managedBy},
 				},
 
-				"spec": map[string]interface{}{
-					"asNumber": localAS,
-					"peerIP":   prIP,
-				},
+				"spec": spec,
 			},
 		}
 
+		cnictx.recordK8SOperation("apply", "BGPPeer", bgpPeerName, pryaml.Object)
 		appliedPr, err := calicoset.Resource(gvrBGPPr).Apply(context.TODO(), bgpPeerName, &pryaml, applyOps)
 		if err != nil {
 			return err
@@ -237,25 +659,46 @@ func (cniconf *CNIConfig) setupCalicoOnK8S(ctx context.Context) error {
 	return nil
 }
 
-func (cniconf *CNIConfig) setupFlannelOnK8S(ctx context.Context) error {
-	slog := utils.LogFromContext(ctx)
-	k8sclient := newKubeClient(cniconf.kubeConfig)
+func (cniconf *CNIConfig) setupFlannelOnK8S(cnictx *CNIContext) error {
+	slog := utils.LogFromContext(cnictx)
+	k8sclient, err := kubeClientOf(cniconf.kubeConfig)
+	if err != nil {
+		return err
+	}
 	for _, nc := range cniconf.Flannel.NodeConfigs {
-		nodeName := fmt.Sprintf("bigip-%s", nc.PublicIP)
-		macAddr, err := cniconf.macAddrOf(nc.PublicIP)
-		if err != nil {
-			return err
+		nodeName := nc.nodeName()
+		annotations := map[string]string{
+			"flannel.alpha.coreos.com/backend-type":        "vxlan",
+			"flannel.alpha.coreos.com/kube-subnet-manager": "true",
+		}
+		podCIDRs := []string{}
+		if nc.PublicIP != "" {
+			macAddr, err := cniconf.macAddrOf(nc.PublicIP)
+			if err != nil {
+				return err
+			}
+			annotations["flannel.alpha.coreos.com/public-ip"] = normalizedIP(nc.PublicIP)
+			annotations["flannel.alpha.coreos.com/backend-data"] = fmt.Sprintf(`{"VtepMAC":"%s"}`, macAddr)
+			podCIDRs = append(podCIDRs, nc.PodCIDR)
+		}
+		if nc.PublicIPv6 != "" {
+			macAddr, err := cniconf.macAddrOf(nc.PublicIPv6)
+			if err != nil {
+				return err
+			}
+			annotations["flannel.alpha.coreos.com/public-ipv6"] = normalizedIP(nc.PublicIPv6)
+			annotations["flannel.alpha.coreos.com/backend-v6-data"] = fmt.Sprintf(`{"VtepMAC":"%s"}`, macAddr)
+			podCIDRs = append(podCIDRs, nc.PodCIDRv6)
 		}
 		nodeConf := confv1.Node(nodeName)
 		nodeConf.WithName(nodeName)
-		nodeConf.WithAnnotations(map[string]string{
-			"flannel.alpha.coreos.com/public-ip":           nc.PublicIP,
-			"flannel.alpha.coreos.com/backend-data":        fmt.Sprintf(`{"VtepMAC":"%s"}`, macAddr),
-			"flannel.alpha.coreos.com/backend-type":        "vxlan",
-			"flannel.alpha.coreos.com/kube-subnet-manager": "true",
-		})
-		nodeConf = nodeConf.WithSpec(confv1.NodeSpec().WithPodCIDR(nc.PodCIDR))
-		if _, err := k8sclient.CoreV1().Nodes().Apply(context.TODO(), nodeConf, metav1.ApplyOptions{FieldManager: "v1"}); err != nil {
+		nodeConf.WithAnnotations(annotations)
+		nodeConf.WithLabels(map[string]string{labelManagedBy: managedBy})
+		// podCIDR is the first of podCIDRs, as kube-controller-manager does for dual-stack nodes.
+		nodeConf = nodeConf.WithSpec(confv1.NodeSpec().WithPodCIDR(podCIDRs[0]).WithPodCIDRs(podCIDRs...))
+		cnictx.recordK8SOperation("apply", "Node", nodeName, nodeConf)
+		applyOps := metav1.ApplyOptions{FieldManager: "v1", DryRun: cnictx.dryRun()}
+		if _, err := k8sclient.CoreV1().Nodes().Apply(context.TODO(), nodeConf, applyOps); err != nil {
 			return err
 		} else {
 			slog.Infof("node %s created in k8s.", nodeName)
@@ -264,48 +707,123 @@ func (cniconf *CNIConfig) setupFlannelOnK8S(ctx context.Context) error {
 	return nil
 }
 
-func (cniconf *CNIConfig) setupCiliumOnK8S(ctx context.Context) error {
-	slog := utils.LogFromContext(ctx)
-
-	slog.Infof("Please confirm cilium is installed as expected. ")
-	slog.Infof(" 	And run the following command line on k8s control-plane node:")
-	slog.Infof("	If there are multiple BIG-IPs configured for the same k8s, you may need to combine the vtep part.")
-	slog.Infof(`
-		helm upgrade cilium <downloaded cilium installation directory>/install/kubernetes/cilium \
-			--namespace kube-system \
-			--set rollOutCiliumPods=true \
-			--set debug.enabled=true \
-			--set kubeProxyReplacement=strict \
-			--set ipam.mode="kubernetes" \
-			--set k8sServiceHost=%s \
-			--set k8sServicePort=%s \
-			--set l7Proxy=false \
-			--set vtep.enabled="true" \
-			--set vtep.endpoint="%s" \
-			--set vtep.mask="%s" \
-			--set vtep.cidr="%s" \
-			--set vtep.mac="%s" 
-	`,
-		"<k8s api-server host>",
-		"<k8s api-server port>",
-		"<traffic selfip>",
-		"<traffic selfip mask>",
-		"<tunnel selfip>/<tunnel selfip mask>",
-		"<tunnel mac from: tmsh show net tunnels tunnel fl-tunnel all-properties>",
-	)
+func (cniconf *CNIConfig) teardownCalicoOnK8S(cnictx *CNIContext) error {
+	slog := utils.LogFromContext(cnictx)
+	calicoset, err := calicoClientOf(cniconf.kubeConfig)
+	if err != nil {
+		return err
+	}
+
+	group, version := "crd.projectcalico.org", "v1"
+	gvrBGPPr := schema.GroupVersionResource{
+		Group:    group,
+		Version:  version,
+		Resource: "bgppeers",
+	}
+	// the labeled ones cover the peers removed from the configuration,
+	// and the ones of the configuration cover the peers created before being labeled.
+	names := map[string]bool{}
+	for bgpPeerName := range cniconf.bgpPeers(0) {
+		names[bgpPeerName] = true
+	}
+	labeled, err := calicoset.Resource(gvrBGPPr).List(context.TODO(), metav1.ListOptions{LabelSelector: labelManagedBy + "=" + managedBy})
+	if err != nil {
+		return err
+	}
+	for _, item := range labeled.Items {
+		names[item.GetName()] = true
+	}
+	for _, bgpPeerName := range sortedNames(names) {
+		cnictx.recordK8SOperation("delete", "BGPPeer", bgpPeerName, nil)
+		err := calicoset.Resource(gvrBGPPr).Delete(context.TODO(), bgpPeerName, metav1.DeleteOptions{DryRun: cnictx.dryRun()})
+		if k8serrors.IsNotFound(err) {
+			slog.Infof("BGPPeer %s not found, skipped", bgpPeerName)
+		} else if err != nil {
+			return err
+		} else {
+			slog.Infof("successfully deleted BGPPeer: %s", bgpPeerName)
+		}
+	}
+
+	gvrBGPConf := schema.GroupVersionResource{
+		Group:    group,
+		Version:  version,
+		Resource: "bgpconfigurations",
+	}
+	bgpConfName := "default"
+	if _, err := calicoset.Resource(gvrBGPConf).Get(context.TODO(), bgpConfName, metav1.GetOptions{}); k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// applying with no fields releases the ones owned by the tool, so that the settings of others are kept.
+	confyaml := unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": strings.Join([]string{group, version}, "/"),
+			"kind":       "BGPConfiguration",
+			"metadata":   map[string]interface{}{"name": bgpConfName},
+		},
+	}
+	applyOps := metav1.ApplyOptions{FieldManager: strings.Join([]string{group, version}, "/"), DryRun: cnictx.dryRun()}
+	cnictx.recordK8SOperation("apply", "BGPConfiguration", bgpConfName, confyaml.Object)
+	if _, err := calicoset.Resource(gvrBGPConf).Apply(context.TODO(), bgpConfName, &confyaml, applyOps); err != nil {
+		return err
+	}
+	slog.Infof("successfully released the fields of BGPConfiguration: %s", bgpConfName)
+	return nil
+}
 
+func (cniconf *CNIConfig) teardownFlannelOnK8S(cnictx *CNIContext) error {
+	slog := utils.LogFromContext(cnictx)
+	k8sclient, err := kubeClientOf(cniconf.kubeConfig)
+	if err != nil {
+		return err
+	}
+	// the same as BGPPeers in teardownCalicoOnK8S.
+	names := map[string]bool{}
+	for _, nc := range cniconf.Flannel.NodeConfigs {
+		names[nc.nodeName()] = true
+	}
+	labeled, err := k8sclient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: labelManagedBy + "=" + managedBy})
+	if err != nil {
+		return err
+	}
+	for _, node := range labeled.Items {
+		names[node.Name] = true
+	}
+	for _, nodeName := range sortedNames(names) {
+		cnictx.recordK8SOperation("delete", "Node", nodeName, nil)
+		err := k8sclient.CoreV1().Nodes().Delete(context.TODO(), nodeName, metav1.DeleteOptions{DryRun: cnictx.dryRun()})
+		if k8serrors.IsNotFound(err) {
+			slog.Infof("node %s not found in k8s, skipped.", nodeName)
+		} else if err != nil {
+			return err
+		} else {
+			slog.Infof("node %s deleted from k8s.", nodeName)
+		}
+	}
 	return nil
 }
 
+// sortedNames returns the names in the set in order.
+func sortedNames(names map[string]bool) []string {
+	rlt := []string{}
+	for name := range names {
+		rlt = append(rlt, name)
+	}
+	sort.Strings(rlt)
+	return rlt
+}
+
 func (cniconf *CNIConfig) parseFlannelConfig() map[string]interface{} {
 	ncfgs := map[string]interface{}{}
 
 	for _, tunnel := range cniconf.Flannel.Tunnels {
 		ncfgs["net/tunnels/vxlan/"+tunnel.ProfileName] = parseVxlanProfile(tunnel.ProfileName, tunnel.Port, "none")
-		ncfgs["net/tunnels/tunnel/"+tunnel.Name] = parseTunnel(tunnel.Name, "1", tunnel.LocalAddress, tunnel.ProfileName)
+		ncfgs["net/tunnels/tunnel/"+tunnel.Name] = parseTunnel(tunnel.Name, "1", withRouteDomain(tunnel.LocalAddress, cniconf.routeDomain()), tunnel.ProfileName)
 	}
 	for _, selfip := range cniconf.Flannel.SelfIPs {
-		ncfgs["net/self/"+selfip.Name] = parseSelf(selfip.Name, selfip.IpMask, selfip.VlanOrTunnelName)
+		ncfgs["net/self/"+selfip.Name] = parseSelf(selfip.Name, withRouteDomain(selfip.IpMask, cniconf.routeDomain()), selfip.VlanOrTunnelName)
 	}
 
 	return ncfgs
@@ -315,7 +833,7 @@ func (cniconf *CNIConfig) parseCalicoConfig() map[string]interface{} {
 
 	ncfgs := map[string]interface{}{}
 	for _, selfip := range cniconf.Calico.SelfIPs {
-		ncfgs["net/self/"+selfip.Name] = parseSelf(selfip.Name, selfip.IpMask, selfip.VlanOrTunnelName)
+		ncfgs["net/self/"+selfip.Name] = parseSelf(selfip.Name, withRouteDomain(selfip.IpMask, cniconf.routeDomain()), selfip.VlanOrTunnelName)
 	}
 
 	return ncfgs
@@ -327,10 +845,10 @@ func (cniconf *CNIConfig) parseCiliumConfig() map[string]interface{} {
 
 	for _, tunnel := range cniconf.Cilium.Tunnels {
 		ncfgs["net/tunnels/vxlan/"+tunnel.ProfileName] = parseVxlanProfile(tunnel.ProfileName, tunnel.Port, "multipoint")
-		ncfgs["net/tunnels/tunnel/"+tunnel.Name] = parseTunnel(tunnel.Name, "2", tunnel.LocalAddress, tunnel.ProfileName)
+		ncfgs["net/tunnels/tunnel/"+tunnel.Name] = parseTunnel(tunnel.Name, "2", withRouteDomain(tunnel.LocalAddress, cniconf.routeDomain()), tunnel.ProfileName)
 	}
 	for _, selfip := range cniconf.Cilium.SelfIPs {
-		ncfgs["net/self/"+selfip.Name] = parseSelf(selfip.Name, selfip.IpMask, selfip.VlanOrTunnelName)
+		ncfgs["net/self/"+selfip.Name] = parseSelf(selfip.Name, withRouteDomain(selfip.IpMask, cniconf.routeDomain()), selfip.VlanOrTunnelName)
 	}
 	for _, route := range cniconf.Cilium.Routes {
 		rn := strings.Split(route.Network, "/")
@@ -341,7 +859,7 @@ func (cniconf *CNIConfig) parseCiliumConfig() map[string]interface{} {
 		ncfgs["net/route/"+rn[0]] = map[string]interface{}{
 			"tmInterface": route.TmInterface,
 			"name":        rn[0],
-			"network":     route.Network,
+			"network":     withRouteDomain(route.Network, cniconf.routeDomain()),
 		}
 	}
 	return ncfgs
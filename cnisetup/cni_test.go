@@ -0,0 +1,110 @@
+package cnisetup
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestTunnelMacOfInDryRun(t *testing.T) {
+	c := fakeBIGIP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/mgmt/tm/sys/version", "/mgmt/tm/net/tunnels/tunnel/~k8s~fl-tunnel":
+			io.WriteString(w, `{}`)
+		case "/mgmt/tm/net/tunnels/tunnel/~k8s~fl-tunnel/stats", "/mgmt/tm/net/tunnels/tunnel/~k8s~denied":
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"code": 401, "message": "Authorization failed"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code": 404}`)
+		}
+	})
+	bc, err := c.newBIGIPContext(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnictx := &CNIContext{Context: context.TODO(), Plan: &CNIPlan{}}
+
+	cases := []struct {
+		name string
+		mac  string
+		err  string
+	}{
+		{name: "new-tunnel", mac: "<mac of tunnel new-tunnel>"},
+		{name: "denied", err: "Authorization failed"},
+		{name: "fl-tunnel", err: "Authorization failed"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mac, err := cnictx.tunnelMacOf(bc, "k8s", tc.name)
+			if tc.err == "" && (err != nil || mac != tc.mac) {
+				t.Errorf("got '%s', %v, want '%s'", mac, err, tc.mac)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("got '%s', %v, want error '%s'", mac, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestNamesOfIPs(t *testing.T) {
+	cases := []struct {
+		nc   FlannelNodeConfig
+		node string
+	}{
+		{nc: FlannelNodeConfig{PublicIP: "10.250.17.219"}, node: "bigip-10.250.17.219"},
+		{nc: FlannelNodeConfig{PublicIP: "10.250.17.219", PublicIPv6: "2001:db8::219"}, node: "bigip-10.250.17.219"},
+		{nc: FlannelNodeConfig{PublicIPv6: "2001:db8::219"}, node: "bigip-2001-db8--219"},
+		{nc: FlannelNodeConfig{PublicIPv6: "2001:0DB8:0:0:0:0:0:ABC"}, node: "bigip-2001-db8--abc"},
+		{nc: FlannelNodeConfig{PublicIPv6: "2001:db8::"}, node: "bigip-2001-db8--0"},
+		{nc: FlannelNodeConfig{PublicIPv6: "::1"}, node: "bigip---1"},
+	}
+	for _, tc := range cases {
+		if name := tc.nc.nodeName(); name != tc.node {
+			t.Errorf("nodeName of %+v: got %s, want %s", tc.nc, name, tc.node)
+		}
+		if msgs := validation.IsDNS1123Subdomain(tc.nc.nodeName()); len(msgs) > 0 {
+			t.Errorf("nodeName of %+v: %v", tc.nc, msgs)
+		}
+	}
+
+	for peerIP, want := range map[string]string{
+		"10.250.17.111": "bgppeer-bigip-10.250.17.111",
+		"FD00::111":     "bgppeer-bigip-fd00--111",
+		"fd00:0::":      "bgppeer-bigip-fd00--0",
+	} {
+		if name := bgpPeerNameOf(peerIP); name != want {
+			t.Errorf("bgpPeerNameOf(%s): got %s, want %s", peerIP, name, want)
+		}
+	}
+}
+
+func TestMacAddrOf(t *testing.T) {
+	c := configOf(t, `flannel:
+  tunnels:
+    - name: fl-tunnel
+      localAddress: 10.250.17.219
+    - name: fl-tunnel6
+      localAddress: "2001:db8::"
+`)
+	c.Flannel.Tunnels[0].tunnelMac, c.Flannel.Tunnels[1].tunnelMac = "00:50:56:86:6e:b4", "00:50:56:86:6e:b6"
+	cases := []struct {
+		publicIP string
+		mac      string
+	}{
+		{publicIP: "10.250.17.219", mac: "00:50:56:86:6e:b4"},
+		{publicIP: "2001:DB8:0::0", mac: "00:50:56:86:6e:b6"},
+		{publicIP: "10.250.17.220"},
+	}
+	for _, tc := range cases {
+		mac, err := c.macAddrOf(tc.publicIP)
+		if mac != tc.mac || (err == nil) != (tc.mac != "") {
+			t.Errorf("macAddrOf(%s): got '%s', %v, want '%s'", tc.publicIP, mac, err, tc.mac)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cnisetup
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// nodeSyncState is the result of the last HandleNodeChanges, for the readiness check.
+type nodeSyncState struct {
+	mutex       sync.Mutex
+	at          time.Time
+	err         error
+	lastSuccess time.Time
+}
+
+var lastNodeSync nodeSyncState
+
+func (ns *nodeSyncState) record(err error) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.at, ns.err = time.Now(), err
+	if err == nil {
+		ns.lastSuccess = ns.at
+	}
+}
+
+// ReadyChecker returns the readiness check, which fails if any BIG-IP didn't answer its last REST call,
+// or the last HandleNodeChanges failed, or, with window > 0, it didn't succeed within the window.
+func (cnictx *CNIContext) ReadyChecker(window time.Duration) func(req *http.Request) error {
+	return func(_ *http.Request) error {
+		lastNodeSync.mutex.Lock()
+		at, err, lastSuccess := lastNodeSync.at, lastNodeSync.err, lastNodeSync.lastSuccess
+		lastNodeSync.mutex.Unlock()
+		if at.IsZero() {
+			return fmt.Errorf("nodes are not synced to BIG-IPs yet")
+		}
+		if err != nil {
+			return fmt.Errorf("the last sync of nodes failed at %s: %s", at.Format(time.RFC3339), err.Error())
+		}
+		if window > 0 && time.Since(lastSuccess) > window {
+			return fmt.Errorf("no successful sync of nodes in %s, the last one at %s", window, lastSuccess.Format(time.RFC3339))
+		}
+
+		// the entries of the same BIG-IP and partition share the connection of the first one.
+		for _, cs := range cnictx.CNIConfigs.byBIGIP() {
+			conn, err := cs[0].connection()
+			if err != nil {
+				return err
+			}
+			if err := conn.probe.LastError(); err != nil {
+				return fmt.Errorf("BIG-IP %s failed the last REST call: %s", cs[0].Management.IpAddress, err.Error())
+			}
+		}
+		return nil
+	}
+}
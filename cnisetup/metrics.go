@@ -0,0 +1,128 @@
+package cnisetup
+
+import (
+	"strings"
+	"time"
+
+	f5_bigip "f5-tool-setup-cni/third_party/f5-bigip-rest-go/bigip"
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// the metrics are registered to the registry of controller-runtime,
+// and served by the manager at -metrics-bind-address in daemon mode.
+var (
+	syncTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "setup_cni_sync_total",
+			Help: "count of the node syncs to BIG-IP, by result: success or failure",
+		},
+		[]string{"bigip", "partition", "result"},
+	)
+	syncDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "setup_cni_sync_duration_seconds",
+			Help:    "time cost of the node syncs to BIG-IP",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"bigip", "partition"},
+	)
+	lastSyncTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "setup_cni_last_sync_timestamp_seconds",
+			Help: "unix time of the last successful node sync to BIG-IP",
+		},
+		[]string{"bigip", "partition"},
+	)
+	fdbRecords = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "setup_cni_fdb_records",
+			Help: "number of the fdb records of the tunnels on BIG-IP, as of the last successful sync",
+		},
+		[]string{"bigip", "partition"},
+	)
+	bgpNeighbors = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "setup_cni_bgp_neighbors",
+			Help: "number of the bgp neighbors on BIG-IP, as of the last successful sync",
+		},
+		[]string{"bigip", "partition"},
+	)
+	restErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "setup_cni_rest_errors_total",
+			Help: "count of the failed iControl REST calls to BIG-IP, by the kind of object, i.e. net/fdb/tunnel",
+		},
+		[]string{"bigip", "kind"},
+	)
+	tunnelMacRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "setup_cni_tunnel_mac_retries_total",
+			Help: "count of the retries of reading the MAC address of tunnels on BIG-IP",
+		},
+		[]string{"bigip"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		syncTotal,
+		syncDuration,
+		lastSyncTimestamp,
+		fdbRecords,
+		bgpNeighbors,
+		restErrorsTotal,
+		tunnelMacRetriesTotal,
+		// the time costs recorded by the f5-bigip-rest-go library, i.e. utils.TimeItToPrometheus.
+		utils.FunctionDurationTimeCostTotal,
+		utils.FunctionDurationTimeCostCount,
+		f5_bigip.BIGIPiControlTimeCostTotal,
+		f5_bigip.BIGIPiControlTimeCostCount,
+	)
+}
+
+// observeSync records the result of a node sync to BIG-IP, with the configs deployed if succeeded.
+func observeSync(bigip, partition string, started time.Time, cfgs map[string]interface{}, err error) {
+	syncDuration.WithLabelValues(bigip, partition).Observe(time.Since(started).Seconds())
+	if err != nil {
+		syncTotal.WithLabelValues(bigip, partition, "failure").Inc()
+		return
+	}
+	syncTotal.WithLabelValues(bigip, partition, "success").Inc()
+	lastSyncTimestamp.WithLabelValues(bigip, partition).SetToCurrentTime()
+
+	records, neighbors := 0, 0
+	for k, v := range cfgs {
+		body, _ := v.(map[string]interface{})
+		switch {
+		case strings.HasPrefix(k, "net/fdb/tunnel/"):
+			rs, _ := body["records"].([]interface{})
+			records += len(rs)
+		case strings.HasPrefix(k, "net/routing/bgp/"):
+			ns, _ := body["neighbor"].([]interface{})
+			neighbors += len(ns)
+		}
+	}
+	fdbRecords.WithLabelValues(bigip, partition).Set(float64(records))
+	bgpNeighbors.WithLabelValues(bigip, partition).Set(float64(neighbors))
+}
+
+// countRestError counts err, if any, as a failed REST call for the kind of object, and returns it as is.
+func countRestError(bc *f5_bigip.BIGIPContext, kind string, err error) error {
+	if err != nil {
+		restErrorsTotal.WithLabelValues(bc.URL, kind).Inc()
+	}
+	return err
+}
+
+// kindOfFailure returns the kind of the object in the failed requests of a transaction,
+// by matching its path in the error message from BIG-IP, or "transaction" if not found.
+func kindOfFailure(cmds *[]f5_bigip.RestRequest, err error) string {
+	for _, r := range *cmds {
+		if r.ResName != "" && strings.Contains(err.Error(), utils.Refname(r.Partition, r.Subfolder, r.ResName)) {
+			return r.Kind
+		}
+	}
+	return "transaction"
+}
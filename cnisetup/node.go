@@ -2,12 +2,22 @@ package cnisetup
 
 import (
 	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
 
-	f5_bigip "github.com/f5devcentral/f5-bigip-rest-go/bigip"
-	"github.com/f5devcentral/f5-bigip-rest-go/utils"
+	f5_bigip "f5-tool-setup-cni/third_party/f5-bigip-rest-go/bigip"
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
 	"github.com/google/uuid"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -23,48 +33,203 @@ type NodeReconciler struct {
 func (r *NodeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	lctx := context.WithValue(ctx, utils.CtxKey_Logger, utils.NewLog().WithRequestID(uuid.New().String()).WithLevel(r.LogLevel))
 	slog := utils.LogFromContext(lctx)
-	slog.Infof("node event: %s", req.Name)
+	slog.Infof("syncing nodes for the changes")
 
-	return ctrl.Result{}, HandleNodeChanges(CNIContext{Context: lctx, CNIConfigs: *r.CNIConfigs})
+	return ctrl.Result{}, HandleNodeChanges(CNIContext{Context: lctx, CNIConfigs: *r.CNIConfigs, NodeReader: r.Client})
 }
 
-func HandleNodeChanges(cnictx CNIContext) error {
-	ocfgs := map[string]interface{}{}
-	ncfgs := map[string]interface{}{}
+// nodesRequest is the only request of NodeReconciler, for each reconcile syncs all the nodes.
+var nodesRequest = ctrl.Request{NamespacedName: types.NamespacedName{Name: "nodes"}}
 
-	cniconf := cnictx.CNIConfigs
+// nodeEventHandler enqueues nodesRequest for the node events, delayed by debounce if set,
+// so that the events within the window are coalesced into one sync.
+func nodeEventHandler(debounce time.Duration, loglevel string) handler.EventHandler {
+	enqueue := func(obj client.Object, q workqueue.RateLimitingInterface) {
+		utils.NewLog().WithLevel(loglevel).Debugf("node event: %s", obj.GetName())
+		if debounce > 0 {
+			q.AddAfter(nodesRequest, debounce)
+		} else {
+			q.Add(nodesRequest)
+		}
+	}
+	return handler.Funcs{
+		CreateFunc: func(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.Object, q)
+		},
+		UpdateFunc: func(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.ObjectNew, q)
+		},
+		DeleteFunc: func(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.Object, q)
+		},
+		GenericFunc: func(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.Object, q)
+		},
+	}
+}
+
+// nodePredicate passes the creations, deletions and the updates relevant to CNI only.
+var nodePredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, ok := e.ObjectOld.(*v1.Node)
+		if !ok {
+			return true
+		}
+		newNode, ok := e.ObjectNew.(*v1.Node)
+		if !ok {
+			return true
+		}
+		return nodeChangedForCNI(oldNode, newNode)
+	},
+}
+
+// nodeChangedForCNI tells whether the node update affects the fdb records or bgp neighbors,
+// unlike the heartbeats and conditions in status.
+func nodeChangedForCNI(oldNode, newNode *v1.Node) bool {
+	return !reflect.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses) ||
+		!reflect.DeepEqual(oldNode.Labels, newNode.Labels) ||
+		nodeIsTaint(oldNode) != nodeIsTaint(newNode) ||
+		!reflect.DeepEqual(cniAnnotationsOf(oldNode), cniAnnotationsOf(newNode))
+}
+
+// cniAnnotationsOf returns the flannel and calico annotations of the node.
+func cniAnnotationsOf(n *v1.Node) map[string]string {
+	rlt := map[string]string{}
+	for k, v := range n.Annotations {
+		if strings.HasPrefix(k, "flannel.alpha.coreos.com/") || strings.HasPrefix(k, "projectcalico.org/") {
+			rlt[k] = v
+		}
+	}
+	return rlt
+}
+
+func HandleNodeChanges(cnictx CNIContext) (err error) {
 	ctx := cnictx.Context
 
 	slog := utils.LogFromContext(cnictx.Context)
+	if cnictx.Plan == nil {
+		defer func() { lastNodeSync.record(err) }()
+	}
 
-	for _, c := range cniconf {
-		clientset := newKubeClient(c.kubeConfig)
-		nodeList, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	// the nodes are listed once for all BIG-IPs of the same cluster.
+	nodeLists := map[string]*v1.NodeList{}
+	for _, cs := range cnictx.CNIConfigs.byBIGIP() {
+		nodeList, ok := nodeLists[cs[0].kubeConfig]
+		if !ok {
+			nodeList, err = cnictx.listNodes(ctx, cs[0].kubeConfig)
+			if err != nil {
+				slog.Errorf("failed to list nodes: %s", err.Error())
+				return err
+			}
+			nodeLists[cs[0].kubeConfig] = nodeList
+		}
+		started := time.Now()
+		cfgs, err := cnictx.syncNodes(cs, nodeList)
+		observeSync(cs[0].bigipUrl(), cs[0].partition(), started, cfgs, err)
 		if err != nil {
-			slog.Errorf("failed to list nodes: %s", err.Error())
 			return err
 		}
-		if ncfgs, err = parseNodeConfigs(ctx, &c, nodeList); err != nil {
-			return err
+	}
+
+	return nil
+}
+
+// listNodes lists the nodes from the informer cache with NodeReader if set, otherwise from the API server.
+func (cnictx *CNIContext) listNodes(ctx context.Context, kubeConfig string) (*v1.NodeList, error) {
+	nodeList := &v1.NodeList{}
+	if cnictx.NodeReader != nil {
+		if err := cnictx.NodeReader.List(ctx, nodeList); err != nil {
+			return nil, err
+		}
+		return nodeList, nil
+	}
+	k8sclient, err := kubeClientOf(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return k8sclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+}
+
+// syncNodes deploys the node settings, i.e. fdb records and bgp neighbors, to the BIG-IP of the configs,
+// and returns the configs deployed.
+func (cnictx *CNIContext) syncNodes(cs []*CNIConfig, nodeList *v1.NodeList) (map[string]interface{}, error) {
+	ctx := cnictx.Context
+	slog := utils.LogFromContext(ctx)
+
+	bc, err := cs[0].newBIGIPContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfgs := map[string]interface{}{}
+	for _, c := range cs {
+		rdPath := ""
+		if c.Calico != nil && c.routeDomain() != 0 {
+			rd, err := routeDomainOf(bc, c.routeDomain())
+			if err != nil {
+				return nil, err
+			}
+			rdPath = rd["fullPath"].(string)
+		}
+		ncfgs, err := parseNodeConfigs(ctx, c, nodeList, rdPath)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range ncfgs[""].(map[string]interface{}) {
+			cfgs[k] = v
 		}
-		bigip := f5_bigip.New(c.bigipUrl(), c.Management.Username, c.Management.password)
-		bc := &f5_bigip.BIGIPContext{BIGIP: *bigip, Context: ctx}
+	}
 
-		if err := deploy(bc, "Common", &ocfgs, &ncfgs); err != nil {
-			slog.Errorf("failed to do deployment: %s", err.Error())
+	if err := cnictx.converge(bc, cs[0].partition(), stateKeyNodes, &map[string]interface{}{"": cfgs}); err != nil {
+		slog.Errorf("failed to do deployment: %s", err.Error())
+		return nil, err
+	}
+	return cfgs, nil
+}
+
+// converge deploys ncfgs to BIG-IP with the last applied configs as the old ones,
+// so that the objects no longer in ncfgs are deleted, and then records ncfgs as the last applied.
+func (cnictx *CNIContext) converge(bc *f5_bigip.BIGIPContext, partition, stateKey string, ncfgs *map[string]interface{}) error {
+	stateKey = stateKeyOf(stateKey, partition)
+	ocfgs, err := loadLastApplied(bc, stateKey)
+	if err != nil {
+		return err
+	}
+	if cnictx.Plan == nil {
+		if err := deployPartition(bc, partition); err != nil {
 			return err
 		}
+	} else if partition != "Common" {
+		if exists, err := bc.Exist("sys/folder", "", partition, ""); err != nil {
+			return countRestError(bc, "sys/folder", err)
+		} else if exists == nil {
+			cnictx.Plan.addBIGIPOperation(bc, "POST", "/mgmt/tm/sys/folder", map[string]interface{}{"name": partition, "partition": "/"})
+		}
 	}
-
-	return nil
+	if err := cnictx.deploy(bc, partition, ocfgs, ncfgs); err != nil {
+		return err
+	}
+	if cnictx.Plan != nil {
+		return nil
+	}
+	return saveLastApplied(bc, stateKey, ncfgs)
 }
 
-func deploy(bc *f5_bigip.BIGIPContext, partition string, ocfgs, ncfgs *map[string]interface{}) error {
+func (cnictx *CNIContext) deploy(bc *f5_bigip.BIGIPContext, partition string, ocfgs, ncfgs *map[string]interface{}) error {
 	defer utils.TimeItToPrometheus()()
 
 	cmds, err := bc.GenRestRequests(partition, ocfgs, ncfgs)
 	if err != nil {
-		return err
+		return countRestError(bc, "query", err)
+	}
+	if bcmds, err := json.Marshal(redactedCmds(cmds)); err == nil {
+		utils.LogFromContext(cnictx).Debugf("commands: %s", bcmds)
 	}
-	return bc.DoRestRequests(cmds)
+	if cnictx.Plan != nil {
+		cnictx.Plan.addRestRequests(bc, cmds)
+		return nil
+	}
+	if err := bc.DoRestRequests(cmds); err != nil {
+		return countRestError(bc, kindOfFailure(cmds, err), err)
+	}
+	return nil
 }
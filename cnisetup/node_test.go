@@ -0,0 +1,150 @@
+package cnisetup
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// configOf parses a configuration entry.
+func configOf(t *testing.T, content string) *CNIConfig {
+	t.Helper()
+	c := &CNIConfig{}
+	if err := yaml.Unmarshal([]byte(content), c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// fakeBIGIP serves the requests by handler, or answers the queries with no existing objects if handler is nil.
+func fakeBIGIP(t *testing.T, handler http.HandlerFunc) *CNIConfig {
+	t.Helper()
+	if handler == nil {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"items": []}`)
+		}
+	}
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	host, sport, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	port, _ := strconv.Atoi(sport)
+	c := &CNIConfig{}
+	c.Management.IpAddress, c.Management.Port, c.Management.InsecureSkipVerify = host, &port, true
+	c.setCredentials("admin", "admin-secret")
+	return c
+}
+
+// captureStdout returns what f is writing to stdout, where the loggers created in f write to.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestDeployLogsNoPassword(t *testing.T) {
+	c := fakeBIGIP(t, nil)
+	c.Calico = configOf(t, "calico: {localAS: 64512, remoteAS: 64512}").Calico
+	c.Calico.bgpPassword = "bgp-secret"
+	cfgs, err := c.parseNeighsFrom("", []string{"10.250.17.111"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plan := range []*CNIPlan{{}, nil} {
+		logs := captureStdout(t, func() {
+			ctx := context.WithValue(context.TODO(), utils.CtxKey_Logger, utils.NewLog().WithLevel(utils.LogLevel_Type_TRACE))
+			cnictx := &CNIContext{Context: ctx, Plan: plan}
+			bc, err := c.newBIGIPContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the fake BIG-IP fails the transaction, the requests are logged before that anyway.
+			cnictx.deploy(bc, "Common", nil, &map[string]interface{}{"": cfgs})
+		})
+		if !strings.Contains(logs, "commands: ") || !strings.Contains(logs, "******") {
+			t.Errorf("the redacted commands are not logged: %s", logs)
+		}
+		for _, secret := range []string{"bgp-secret", "admin-secret", "YWRtaW46YWRtaW4tc2VjcmV0"} {
+			if strings.Contains(logs, secret) {
+				t.Errorf("'%s' is logged with plan %v: %s", secret, plan, logs)
+			}
+		}
+	}
+}
+
+func TestNodeChangedForCNI(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{"kubernetes.io/os": "linux"},
+			Annotations: map[string]string{
+				"flannel.alpha.coreos.com/backend-data": `{"VtepMAC":"aa:bb:cc:dd:ee:01"}`,
+				"node.alpha.kubernetes.io/ttl":          "0",
+			},
+		},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.250.17.111"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+	cases := []struct {
+		name    string
+		update  func(n *v1.Node)
+		changed bool
+	}{
+		{name: "no change", update: func(n *v1.Node) {}, changed: false},
+		{name: "heartbeat", update: func(n *v1.Node) {
+			n.Status.Conditions[0].LastHeartbeatTime = metav1.Now()
+			n.ResourceVersion = "2"
+		}, changed: false},
+		{name: "other annotation", update: func(n *v1.Node) { n.Annotations["node.alpha.kubernetes.io/ttl"] = "15" }, changed: false},
+		{name: "address", update: func(n *v1.Node) { n.Status.Addresses[0].Address = "10.250.17.112" }, changed: true},
+		{name: "label", update: func(n *v1.Node) { n.Labels["route-reflector"] = "true" }, changed: true},
+		{name: "flannel annotation", update: func(n *v1.Node) {
+			n.Annotations["flannel.alpha.coreos.com/backend-data"] = `{"VtepMAC":"aa:bb:cc:dd:ee:02"}`
+		}, changed: true},
+		{name: "calico annotation", update: func(n *v1.Node) { n.Annotations["projectcalico.org/IPv4Address"] = "10.250.17.111/24" }, changed: true},
+		{name: "unreachable", update: func(n *v1.Node) {
+			n.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/unreachable", Effect: v1.TaintEffectNoSchedule}}
+		}, changed: true},
+		{name: "other taint", update: func(n *v1.Node) {
+			n.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/disk-pressure", Effect: v1.TaintEffectNoSchedule}}
+		}, changed: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newNode := node.DeepCopy()
+			tc.update(newNode)
+			if changed := nodeChangedForCNI(node, newNode); changed != tc.changed {
+				t.Errorf("got %t, want %t", changed, tc.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package cnisetup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	f5_bigip "f5-tool-setup-cni/third_party/f5-bigip-rest-go/bigip"
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
+)
+
+// CNIPlan collects the operations that would be done to BIG-IPs and k8s in dry-run mode.
+type CNIPlan struct {
+	BIGIP []BIGIPOperation `json:"bigip"`
+	K8S   []K8SOperation   `json:"k8s"`
+}
+
+type BIGIPOperation struct {
+	BIGIP  string      `json:"bigip"`
+	Method string      `json:"method"`
+	Uri    string      `json:"uri"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+type K8SOperation struct {
+	Operation string      `json:"operation"`
+	Kind      string      `json:"kind"`
+	Name      string      `json:"name"`
+	Object    interface{} `json:"object,omitempty"`
+}
+
+func (plan *CNIPlan) addRestRequests(bc *f5_bigip.BIGIPContext, cmds *[]f5_bigip.RestRequest) {
+	for _, r := range *cmds {
+		if r.Method == "NOPE" {
+			continue
+		}
+		uri := r.ResUri
+		var body interface{} = r.Body
+		if r.Method != "POST" {
+			uri = r.ResUri + "/" + utils.Refname(r.Partition, r.Subfolder, r.ResName)
+		}
+		if r.Method == "DELETE" {
+			body = nil
+		}
+		plan.addBIGIPOperation(bc, r.Method, uri, body)
+	}
+}
+
+func (plan *CNIPlan) addBIGIPOperation(bc *f5_bigip.BIGIPContext, method, uri string, body interface{}) {
+	plan.BIGIP = append(plan.BIGIP, BIGIPOperation{
+		BIGIP:  bc.URL,
+		Method: method,
+		Uri:    uri,
+		Body:   redacted(body),
+	})
+}
+
+func (plan *CNIPlan) addK8SOperation(operation, kind, name string, object interface{}) {
+	plan.K8S = append(plan.K8S, K8SOperation{
+		Operation: operation,
+		Kind:      kind,
+		Name:      name,
+		Object:    object,
+	})
+}
+
+// Dumps returns the plan in json format.
+func (plan *CNIPlan) Dumps() (string, error) {
+	bplan, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the plan: %s", err.Error())
+	}
+	return string(bplan), nil
+}
+
+// String returns the plan in human-readable format, one operation per line.
+func (plan *CNIPlan) String() string {
+	lines := []string{
+		fmt.Sprintf("BIG-IP operations: %d", len(plan.BIGIP)),
+	}
+	for _, op := range plan.BIGIP {
+		lines = append(lines, fmt.Sprintf("  %s %-6s %s", op.BIGIP, op.Method, op.Uri))
+	}
+	lines = append(lines, fmt.Sprintf("k8s operations: %d", len(plan.K8S)))
+	for _, op := range plan.K8S {
+		lines = append(lines, fmt.Sprintf("  %-6s %s %s", op.Operation, op.Kind, op.Name))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,107 @@
+package cnisetup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
+	"github.com/google/uuid"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// SecretReconciler reloads the BIG-IP credentials from the referred Secrets when they are rotated.
+type SecretReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	LogLevel   string
+	CNIConfigs *CNIConfigs
+	// Resyncs is watched by the node controller, for requesting a sync of nodes.
+	Resyncs chan<- event.GenericEvent
+}
+
+func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	lctx := context.WithValue(ctx, utils.CtxKey_Logger, utils.NewLog().WithRequestID(uuid.New().String()).WithLevel(r.LogLevel))
+	slog := utils.LogFromContext(lctx)
+	slog.Infof("secret event: %s", req.NamespacedName)
+
+	var secret v1.Secret
+	if err := r.Get(lctx, req.NamespacedName, &secret); err != nil {
+		if k8serrors.IsNotFound(err) {
+			slog.Warnf("secret %s is deleted, keep using the former credentials", req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	rotated := false
+	for _, c := range r.CNIConfigs.referringTo(req.Namespace, req.Name) {
+		username, password, err := credentialsFromSecret(&secret, c.Management.SecretRef)
+		if err == nil && password == "" {
+			err = fmt.Errorf("the password is empty")
+		}
+		if err != nil {
+			slog.Errorf("failed to reload credentials of BIG-IP %s: %s", c.Management.IpAddress, err.Error())
+			continue
+		}
+		if c.setCredentials(username, password) {
+			slog.Infof("credentials of BIG-IP %s are rotated", c.Management.IpAddress)
+			rotated = true
+		}
+	}
+
+	if !rotated {
+		return ctrl.Result{}, nil
+	}
+	// resync with the new credentials, in case of the failures with the former ones.
+	// a pending request covers this one, as the sync reads the latest credentials.
+	select {
+	case r.Resyncs <- event.GenericEvent{Object: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "credentials-rotated"}}}:
+	default:
+	}
+	return ctrl.Result{}, nil
+}
+
+// SecretNamespaces returns the namespaces of the Secrets referred by management.secretRef,
+// for restricting the cache of Secrets in daemon mode.
+func (cniconfs CNIConfigs) SecretNamespaces() []string {
+	namespaces := []string{}
+	found := map[string]bool{}
+	for _, c := range cniconfs.withSecretRef() {
+		if ns := c.Management.SecretRef.Namespace; !found[ns] {
+			found[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// withSecretRef returns the configurations getting credentials from Secrets.
+func (cniconfs CNIConfigs) withSecretRef() []*CNIConfig {
+	rlt := []*CNIConfig{}
+	for i := range cniconfs {
+		if cniconfs[i].Management.SecretRef != nil {
+			rlt = append(rlt, &cniconfs[i])
+		}
+	}
+	return rlt
+}
+
+// referringTo returns the configurations getting credentials from the Secret namespace/name.
+func (cniconfs CNIConfigs) referringTo(namespace, name string) []*CNIConfig {
+	rlt := []*CNIConfig{}
+	for _, c := range cniconfs.withSecretRef() {
+		if c.Management.SecretRef.Namespace == namespace && c.Management.SecretRef.Name == name {
+			rlt = append(rlt, c)
+		}
+	}
+	return rlt
+}
@@ -1,28 +1,115 @@
 package cnisetup
 
-import "context"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
 
 type CNIContext struct {
 	CNIConfigs
 	context.Context
+	// Plan is set in dry-run mode, operations are recorded into it instead of being executed.
+	Plan *CNIPlan
+	// CiliumValuesFile is set to write the cilium vtep settings as helm values to the file,
+	// instead of patching cilium-config, i.e. for cilium managed by GitOps.
+	CiliumValuesFile string
+	// EnableTMOSRouting allows switching BIG-IP from legacy to TMOS routing mode for calico.
+	EnableTMOSRouting bool
+	// NodeDebounce delays the node syncs in daemon mode, so that the node changes within it are synced at once.
+	NodeDebounce time.Duration
+	// NodeReader reads the nodes from the informer cache of the manager in daemon mode, instead of the API server.
+	NodeReader client.Reader
 }
 
 type CNIConfigs []CNIConfig
 
+// credentialsLock guards the BIG-IP credentials, which may be rotated in daemon mode.
+var credentialsLock sync.RWMutex
+
+// data group keys for the last applied configs on each BIG-IP,
+// the routing mode before enableBGPRouting, and the partitions created by deployPartition.
+const (
+	stateKeyConfig     = "setup-cni-config"
+	stateKeyNodes      = "setup-cni-nodes"
+	stateKeyRouting    = "setup-cni-routing"
+	stateKeyPartitions = "setup-cni-partitions"
+)
+
+// the label of the k8s objects created by the tool, i.e. BGPPeers and the flannel Nodes of BIG-IPs,
+// by which they are deleted in uninstall mode, even if removed from the configuration.
+const (
+	labelManagedBy = "app.kubernetes.io/managed-by"
+	managedBy      = "setup-cni"
+)
+
 type BIGIPSelfIP struct {
 	Name             string
 	IpMask           string `yaml:"ipMask"`
 	VlanOrTunnelName string `yaml:"vlanOrTunnelName"`
 }
 
+// FlannelNodeConfig is the BIG-IP virtual node in k8s, with IPv4, IPv6 or both.
+type FlannelNodeConfig struct {
+	PublicIP   string `yaml:"publicIP"`
+	PodCIDR    string `yaml:"podCIDR"`
+	PublicIPv6 string `yaml:"publicIPv6"`
+	PodCIDRv6  string `yaml:"podCIDRv6"`
+}
+
+// GracefulRestart is the bgp graceful restart settings, in seconds.
+type GracefulRestart struct {
+	RestartTime   int `yaml:"restartTime"`
+	StalePathTime int `yaml:"stalePathTime"`
+}
+
+// InOut names the existing BIG-IP route-maps or prefix-lists for the routes accepted and advertised.
+type InOut struct {
+	In  string
+	Out string
+}
+
+// SecretRef refers to a kubernetes Secret holding the BIG-IP credentials.
+type SecretRef struct {
+	Namespace string
+	Name      string
+	// the key of the password in the Secret, default to "password"
+	PasswordKey string `yaml:"passwordKey"`
+	// optional, the key of the username in the Secret, overriding management.username
+	UsernameKey string `yaml:"usernameKey"`
+}
+
 type CNIConfig struct {
 	Management struct {
 		Username  string
 		IpAddress string `yaml:"ipAddress"`
 		Port      *int
-		password  string
+		// credential sources, at most one of them, default to the -bigip-password file
+		PasswordFile string     `yaml:"passwordFile"`
+		PasswordEnv  string     `yaml:"passwordEnv"`
+		SecretRef    *SecretRef `yaml:"secretRef"`
+		// optional, basic or token, default to basic
+		AuthType string `yaml:"authType"`
+		// optional, the login provider for token auth, i.e. for remote users, default to tmos
+		LoginProviderName string `yaml:"loginProviderName"`
+		// optional, CAs for verifying BIG-IP certificate in addition to the system ones, in file or inline PEM
+		CaFile   string `yaml:"caFile"`
+		CaBundle string `yaml:"caBundle"`
+		// optional, the name in BIG-IP certificate if it does not match ipAddress
+		ServerName string `yaml:"serverName"`
+		// optional, skip the verification of BIG-IP certificate, not recommended
+		InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+		password           string
 	}
-	Flannel *struct {
+	// optional, the partition for the BIG-IP objects, default to Common
+	Partition string
+	// optional, the route domain id for the BIG-IP addresses and bgp instance, default to 0
+	RouteDomain *int `yaml:"routeDomain"`
+	// optional, the bgp router name, default to gwcBGP
+	BgpRouterName string `yaml:"bgpRouterName"`
+	Flannel       *struct {
 		Tunnels []struct {
 			Name         string
 			ProfileName  string `yaml:"profileName"`
@@ -30,17 +117,36 @@ type CNIConfig struct {
 			LocalAddress string `yaml:"localAddress"`
 			tunnelMac    string
 		}
-		SelfIPs     []BIGIPSelfIP `yaml:"selfIPs"`
-		NodeConfigs []struct {
-			PublicIP string `yaml:"publicIP"`
-			PodCIDR  string `yaml:"podCIDR"`
-		} `yaml:"nodeConfigs"`
+		SelfIPs     []BIGIPSelfIP       `yaml:"selfIPs"`
+		NodeConfigs []FlannelNodeConfig `yaml:"nodeConfigs"`
 	}
 	Calico *struct {
 		LocalAS  string        `yaml:"localAS"`
 		RemoteAS string        `yaml:"remoteAS"`
 		SelfIPs  []BIGIPSelfIP `yaml:"selfIPs"`
 		PeerIPs  []string      `yaml:"peerIPs"`
+		// optional, calico selector of the nodes peering with peerIPs, i.e. route reflectors, default to all nodes
+		NodeSelector string `yaml:"nodeSelector"`
+		// optional, calico selector of the nodes as peers of all the others, i.e. route reflectors
+		PeerSelector string `yaml:"peerSelector"`
+		// optional, k8s label selector of the nodes as BIG-IP bgp neighbors, default to all nodes
+		NeighborSelector string `yaml:"neighborSelector"`
+		// optional, the bgp session settings of BIG-IP neighbors, the password and the graceful restart time
+		// are set to the BGPPeers too
+		PasswordSecretRef *SecretRef       `yaml:"passwordSecretRef"`
+		KeepAlive         int              `yaml:"keepAlive"`
+		HoldTime          int              `yaml:"holdTime"`
+		EbgpMultihop      int              `yaml:"ebgpMultihop"`
+		BFD               bool             `yaml:"bfd"`
+		GracefulRestart   *GracefulRestart `yaml:"gracefulRestart"`
+		RouteMap          *InOut           `yaml:"routeMap"`
+		PrefixList        *InOut           `yaml:"prefixList"`
+		bgpPassword       string
+		// optional, the fields of the default BGPConfiguration, left to the others if not set
+		NodeToNodeMesh         *bool    `yaml:"nodeToNodeMesh"`
+		ServiceClusterIPs      []string `yaml:"serviceClusterIPs"`
+		ServiceExternalIPs     []string `yaml:"serviceExternalIPs"`
+		ServiceLoadBalancerIPs []string `yaml:"serviceLoadBalancerIPs"`
 	}
 	Cilium *struct {
 		Tunnels []struct {
@@ -57,4 +163,5 @@ type CNIConfig struct {
 		}
 	}
 	kubeConfig string
+	conn       *bigipConn
 }
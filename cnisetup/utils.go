@@ -1,25 +1,32 @@
 package cnisetup
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
-	f5_bigip "github.com/f5devcentral/f5-bigip-rest-go/bigip"
-	"github.com/f5devcentral/f5-bigip-rest-go/utils"
+	f5_bigip "f5-tool-setup-cni/third_party/f5-bigip-rest-go/bigip"
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
 )
 
 // func init() {
@@ -37,8 +44,25 @@ func getConfigs(CNIConfigs *CNIConfigs, configPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to read file: %s: %s", fn, err)
 	}
-	if err := yaml.Unmarshal(byaml, &CNIConfigs); err != nil {
-		return fmt.Errorf("failed to unmarshal yaml content: %s", err.Error())
+	var root yaml.Node
+	if err := yaml.Unmarshal(byaml, &root); err != nil {
+		return syntaxErrors(err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(byaml))
+	decoder.KnownFields(true)
+	errs := ConfigErrors{}
+	if err := decoder.Decode(CNIConfigs); err != nil && err != io.EOF {
+		// the type errors, i.e. unknown fields, are reported together with the validation ones.
+		te, ok := err.(*yaml.TypeError)
+		if !ok {
+			return fmt.Errorf("failed to unmarshal yaml content: %s", err.Error())
+		}
+		errs = append(errs, typeErrors(&root, te)...)
+	}
+	errs = append(errs, validateConfigs(&root, *CNIConfigs)...)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
@@ -52,118 +76,574 @@ func getCredentials(bigipPassword *string, pwPath string) error {
 		if b, err := io.ReadAll(f); err != nil {
 			return err
 		} else {
-			*bigipPassword = string(b)
+			*bigipPassword = strings.TrimSpace(string(b))
+		}
+		return nil
+	}
+}
+
+// getSecretCredentials reads the username and password from the kubernetes Secret,
+// the username is empty if UsernameKey is not specified.
+func getSecretCredentials(kubeConfig string, ref *SecretRef) (string, string, error) {
+	k8sclient, err := kubeClientOf(kubeConfig)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := k8sclient.CoreV1().Secrets(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get secret %s/%s: %s", ref.Namespace, ref.Name, err.Error())
+	}
+	return credentialsFromSecret(secret, ref)
+}
+
+func credentialsFromSecret(secret *v1.Secret, ref *SecretRef) (string, string, error) {
+	passwordKey := ref.PasswordKey
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+	password, ok := secret.Data[passwordKey]
+	if !ok {
+		return "", "", fmt.Errorf("key %s not found in secret %s/%s", passwordKey, ref.Namespace, ref.Name)
+	}
+	username := ""
+	if ref.UsernameKey != "" {
+		if u, ok := secret.Data[ref.UsernameKey]; !ok {
+			return "", "", fmt.Errorf("key %s not found in secret %s/%s", ref.UsernameKey, ref.Namespace, ref.Name)
+		} else {
+			username = strings.TrimSpace(string(u))
 		}
+	}
+	return username, strings.TrimSpace(string(password)), nil
+}
+
+// redacted returns a copy of v with the values of "password" fields masked, for recording or printing.
+func redacted(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		rlt := map[string]interface{}{}
+		for k, iv := range tv {
+			if _, ok := iv.(string); ok && k == "password" {
+				rlt[k] = "******"
+			} else {
+				rlt[k] = redacted(iv)
+			}
+		}
+		return rlt
+	case []interface{}:
+		rlt := []interface{}{}
+		for _, iv := range tv {
+			rlt = append(rlt, redacted(iv))
+		}
+		return rlt
+	default:
+		return v
+	}
+}
+
+// quietContext caps the logger of ctx at info level for f5-bigip-rest-go, which logs the request bodies and headers
+// at debug level, i.e. the bgp password and the Authorization header. The commands are logged by deploy with redacted.
+func quietContext(ctx context.Context) context.Context {
+	if utils.LogFromContext(ctx).Level < utils.LogLevel_DEBUG {
+		return ctx
+	}
+	return context.WithValue(ctx, utils.CtxKey_Logger, utils.NewLog().WithLevel(utils.LogLevel_Type_INFO))
+}
+
+// redactedCmds returns a copy of cmds with the passwords in the bodies redacted, for logging.
+func redactedCmds(cmds *[]f5_bigip.RestRequest) []f5_bigip.RestRequest {
+	rlt := []f5_bigip.RestRequest{}
+	for _, r := range *cmds {
+		r.Body = redacted(r.Body)
+		rlt = append(rlt, r)
+	}
+	return rlt
+}
+
+// stateKeyOf returns the data group key of the last applied configs in the partition.
+func stateKeyOf(key, partition string) string {
+	if partition == "Common" {
+		return key
+	}
+	return key + "." + partition
+}
+
+// loadLastApplied returns the configs recorded by saveLastApplied, nil if nothing recorded yet.
+func loadLastApplied(bc *f5_bigip.BIGIPContext, key string) (*map[string]interface{}, error) {
+	pc, err := bc.LoadDataGroup(key)
+	if err != nil {
+		countRestError(bc, "ltm/data-group/internal", err)
+		return nil, fmt.Errorf("failed to load the last applied configs %s: %s", key, err.Error())
+	}
+	if pc == nil || pc.Rest == "" {
+		return nil, nil
+	}
+	cfgs := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(pc.Rest), &cfgs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the last applied configs %s: %s", key, err.Error())
+	}
+	return &cfgs, nil
+}
+
+// saveLastApplied records the configs to a data group on BIG-IP,
+// so that they can be compared with in the next run, even after restarts.
+func saveLastApplied(bc *f5_bigip.BIGIPContext, key string, cfgs *map[string]interface{}) error {
+	// the objects are deleted by name, so the secrets needn't be recorded in the data group.
+	bcfgs, err := json.Marshal(redacted(*cfgs))
+	if err != nil {
+		return err
+	}
+	// the partition for the data groups, created on the first save, so that dry-run mode never writes BIG-IP.
+	if err := deployPartition(bc, "cis-c-tenant"); err != nil {
+		return err
+	}
+	if err := bc.SaveDataGroup(key, &f5_bigip.PersistedConfig{Rest: string(bcfgs)}); err != nil {
+		countRestError(bc, "ltm/data-group/internal", err)
+		return fmt.Errorf("failed to save the last applied configs %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// deployPartition creates the partition if not existing, and records it to data group stateKeyPartitions,
+// so that it is deleted in uninstall mode once empty. The existing ones, i.e. Common, are never recorded.
+func deployPartition(bc *f5_bigip.BIGIPContext, name string) error {
+	if name == "Common" {
+		return nil
+	}
+	if exists, err := bc.Exist("sys/folder", "", name, ""); err != nil {
+		return countRestError(bc, "sys/folder", err)
+	} else if exists != nil {
 		return nil
 	}
+	if err := bc.DeployPartition(name); err != nil {
+		return countRestError(bc, "sys/folder", err)
+	}
+
+	// the record is in partition cis-c-tenant, which is recorded first if created here.
+	if name != "cis-c-tenant" {
+		if err := deployPartition(bc, "cis-c-tenant"); err != nil {
+			return err
+		}
+	}
+	partitions, err := createdPartitionsOf(bc)
+	if err != nil {
+		return err
+	}
+	return saveLastApplied(bc, stateKeyPartitions, &map[string]interface{}{"partitions": append(partitions, name)})
 }
 
-func enableBGPRouting(bc *f5_bigip.BIGIPContext) error {
+// createdPartitionsOf returns the partitions recorded by deployPartition.
+func createdPartitionsOf(bc *f5_bigip.BIGIPContext) ([]string, error) {
+	state, err := loadLastApplied(bc, stateKeyPartitions)
+	if err != nil {
+		return nil, err
+	}
+	partitions := []string{}
+	if state != nil {
+		ps, _ := (*state)["partitions"].([]interface{})
+		for _, p := range ps {
+			if name, ok := p.(string); ok {
+				partitions = append(partitions, name)
+			}
+		}
+	}
+	return partitions, nil
+}
+
+// deletePartitions deletes the partitions created by deployPartition among the uninstalled ones,
+// and then cis-c-tenant if created by deployPartition as well and no other partition is left in the record.
+// BIG-IP refuses to delete a partition with objects in it, i.e. created by others, which is kept with a warning.
+func (cnictx *CNIContext) deletePartitions(bc *f5_bigip.BIGIPContext, uninstalled map[string]bool) error {
+	slog := utils.LogFromContext(cnictx)
+	created, err := createdPartitionsOf(bc)
+	if err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return nil
+	}
+
+	kept := []string{}
+	tenant := false
+	deleteOrKeep := func(name string) {
+		if cnictx.Plan != nil {
+			cnictx.Plan.addBIGIPOperation(bc, "DELETE", "/mgmt/tm/sys/folder/~"+name, nil)
+		} else if err := bc.DeletePartition(name); err != nil {
+			slog.Warnf("partition %s is kept on BIG-IP %s, not empty or not deletable: %s", name, bc.URL, err.Error())
+			kept = append(kept, name)
+			return
+		}
+		slog.Infof("deleted partition %s from BIG-IP %s", name, bc.URL)
+	}
+	for _, name := range created {
+		if name == "cis-c-tenant" {
+			tenant = true
+		} else if !uninstalled[name] {
+			kept = append(kept, name)
+		} else {
+			deleteOrKeep(name)
+		}
+	}
+
+	if tenant && len(kept) == 0 {
+		if cnictx.Plan == nil {
+			if err := bc.DeleteDataGroup(stateKeyPartitions); err != nil {
+				return err
+			}
+		}
+		deleteOrKeep("cis-c-tenant")
+		if len(kept) == 0 || cnictx.Plan != nil {
+			return nil
+		}
+	} else if tenant {
+		kept = append(kept, "cis-c-tenant")
+	}
+
+	if cnictx.Plan != nil {
+		return nil
+	}
+	if len(kept) == 0 {
+		return bc.DeleteDataGroup(stateKeyPartitions)
+	}
+	return saveLastApplied(bc, stateKeyPartitions, &map[string]interface{}{"partitions": kept})
+}
+
+// routeDomainOf returns the route domain with the id, which may be named differently, i.e. /Common/rd2
+func routeDomainOf(bc *f5_bigip.BIGIPContext, id int) (map[string]interface{}, error) {
+	resp, err := bc.All("net/route-domain")
+	if err != nil {
+		return nil, countRestError(bc, "net/route-domain", err)
+	}
+	if items, ok := (*resp)["items"].([]interface{}); ok {
+		for _, item := range items {
+			rd := item.(map[string]interface{})
+			if rdid, ok := rd["id"].(float64); ok && int(rdid) == id {
+				return rd, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("route domain %d must exist. check it", id)
+}
+
+// tmosRoutingOf returns the value of db key tmrouted.tmos.routing, i.e. enable or disable.
+func tmosRoutingOf(bc *f5_bigip.BIGIPContext) (string, error) {
+	resp, err := bc.All("sys/db/tmrouted.tmos.routing")
+	if err != nil {
+		return "", countRestError(bc, "sys/db", err)
+	}
+	if resp == nil {
+		return "", fmt.Errorf("db key tmrouted.tmos.routing not found")
+	}
+	value, _ := (*resp)["value"].(string)
+	return value, nil
+}
+
+// enableBGPRouting switches BIG-IP to TMOS routing mode for the bgp instance of calico.
+// It does nothing if already switched, otherwise requires EnableTMOSRouting, and records the original state
+// to data group stateKeyRouting before the first change, for restoreBGPRouting on uninstall.
+func (cnictx *CNIContext) enableBGPRouting(bc *f5_bigip.BIGIPContext, routeDomain int) error {
+	slog := utils.LogFromContext(cnictx)
 	kind := "net/route-domain"
-	partition, subfolder, name := "Common", "", "0" // route domain 0
 
-	exists, err := bc.Exist(kind, name, partition, subfolder)
+	exists, err := routeDomainOf(bc, routeDomain)
 	if err != nil {
 		return err
 	}
-	if exists == nil {
-		return fmt.Errorf("route domain 0 must exist. check it")
+	partition, subfolder, name := exists["partition"].(string), "", exists["name"].(string)
+	fullPath := utils.Refname(partition, subfolder, name)
+	tmosRouting, err := tmosRoutingOf(bc)
+	if err != nil {
+		return fmt.Errorf("failed to get the routing mode of BIG-IP %s: %s", bc.URL, err.Error())
 	}
+
 	// "Cannot mix routing-protocol Legacy and TMOS mode for route-domain (/Common/0)."
 	// We need to remove "BGP" from routingProtocol for TMOS mode
-	if (*exists)["routingProtocol"] != nil {
-		nrps := []interface{}{}
-		for _, rp := range (*exists)["routingProtocol"].([]interface{}) {
-			if rp.(string) != "BGP" {
+	legacy := false
+	nrps := []interface{}{}
+	if rps, ok := exists["routingProtocol"].([]interface{}); ok {
+		for _, rp := range rps {
+			if rp.(string) == "BGP" {
+				legacy = true
+			} else {
 				nrps = append(nrps, rp)
 			}
 		}
+	}
+	if tmosRouting == "enable" && !legacy {
+		slog.Debugf("TMOS routing is already enabled for route domain %s", fullPath)
+		return nil
+	}
+	if !cnictx.EnableTMOSRouting {
+		return fmt.Errorf("TMOS routing is required for calico, but tmrouted.tmos.routing is '%s' on BIG-IP %s "+
+			"and route domain %s has legacy BGP: %t. Rerun with -enable-tmos-routing to switch it, "+
+			"which is reverted on uninstall", tmosRouting, bc.URL, fullPath, legacy)
+	}
+
+	// the original state is kept until uninstall, the later changes won't override it.
+	state, err := loadLastApplied(bc, stateKeyRouting)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &map[string]interface{}{"tmrouted.tmos.routing": tmosRouting, "routeDomains": map[string]interface{}{}}
+	}
+	rds, _ := (*state)["routeDomains"].(map[string]interface{})
+	if _, found := rds[fullPath]; !found && legacy {
+		rds[fullPath] = map[string]interface{}{
+			"partition":       partition,
+			"name":            name,
+			"routingProtocol": exists["routingProtocol"],
+		}
+	}
+	(*state)["routeDomains"] = rds
+	if cnictx.Plan == nil {
+		if err := saveLastApplied(bc, stateKeyRouting, state); err != nil {
+			return err
+		}
+	}
+
+	if legacy {
 		body := map[string]interface{}{
 			"routingProtocol": nrps,
 		}
-		if err := bc.Update(kind, name, partition, subfolder, body); err != nil {
+		if cnictx.Plan != nil {
+			cnictx.Plan.addBIGIPOperation(bc, "PATCH", "/mgmt/tm/"+kind+"/"+fullPath, body)
+		} else if err := bc.Update(kind, name, partition, subfolder, body); err != nil {
+			return err
+		}
+		slog.Infof("removed legacy BGP from route domain %s", fullPath)
+	}
+
+	if tmosRouting != "enable" {
+		if cnictx.Plan != nil {
+			cnictx.Plan.addBIGIPOperation(bc, "PATCH", "/mgmt/tm/sys/db/tmrouted.tmos.routing", map[string]interface{}{"value": "enable"})
+		} else if err := modifyDbValue(bc, "tmrouted.tmos.routing", "enable"); err != nil {
+			return err
+		}
+		slog.Infof("TMOS routing enabled on BIG-IP %s, was '%s'", bc.URL, tmosRouting)
+	}
+	return nil
+}
+
+// bgpInstancesOf returns the full paths of the bgp instances on BIG-IP in all partitions, filtered by keep.
+func bgpInstancesOf(bc *f5_bigip.BIGIPContext, keep func(fullPath string) bool) ([]string, error) {
+	resp, err := bc.All("net/routing/bgp")
+	if err != nil {
+		return nil, countRestError(bc, "net/routing/bgp", err)
+	}
+	fullPaths := []string{}
+	if items, ok := (*resp)["items"].([]interface{}); ok {
+		for _, item := range items {
+			bgp, _ := item.(map[string]interface{})
+			if fullPath, ok := bgp["fullPath"].(string); ok && keep(fullPath) {
+				fullPaths = append(fullPaths, fullPath)
+			}
+		}
+	}
+	sort.Strings(fullPaths)
+	return fullPaths, nil
+}
+
+// restoreBGPRouting reverts the changes of enableBGPRouting to the original state recorded, if any.
+func (cnictx *CNIContext) restoreBGPRouting(bc *f5_bigip.BIGIPContext) error {
+	slog := utils.LogFromContext(cnictx)
+	kind := "net/route-domain"
+
+	state, err := loadLastApplied(bc, stateKeyRouting)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+
+	// legacy BGP can be added back to route domains only after leaving TMOS mode.
+	if tmosRouting, ok := (*state)["tmrouted.tmos.routing"].(string); ok && tmosRouting != "enable" {
+		if cnictx.Plan != nil {
+			cnictx.Plan.addBIGIPOperation(bc, "PATCH", "/mgmt/tm/sys/db/tmrouted.tmos.routing", map[string]interface{}{"value": tmosRouting})
+		} else if err := modifyDbValue(bc, "tmrouted.tmos.routing", tmosRouting); err != nil {
 			return err
 		}
+		slog.Infof("tmrouted.tmos.routing restored to '%s' on BIG-IP %s", tmosRouting, bc.URL)
 	}
 
-	return bc.ModifyDbValue("tmrouted.tmos.routing", "enable")
+	rds, _ := (*state)["routeDomains"].(map[string]interface{})
+	fullPaths := []string{}
+	for fullPath := range rds {
+		fullPaths = append(fullPaths, fullPath)
+	}
+	sort.Strings(fullPaths)
+	for _, fullPath := range fullPaths {
+		rd, _ := rds[fullPath].(map[string]interface{})
+		partition, _ := rd["partition"].(string)
+		name, _ := rd["name"].(string)
+		body := map[string]interface{}{
+			"routingProtocol": rd["routingProtocol"],
+		}
+		if cnictx.Plan != nil {
+			cnictx.Plan.addBIGIPOperation(bc, "PATCH", "/mgmt/tm/"+kind+"/"+fullPath, body)
+		} else if err := bc.Update(kind, name, partition, "", body); err != nil {
+			return err
+		}
+		slog.Infof("routing protocols of route domain %s restored", fullPath)
+	}
+
+	if cnictx.Plan != nil {
+		return nil
+	}
+	return bc.DeleteDataGroup(stateKeyRouting)
 }
 
-func newRestConfig(kubeConfig string) *rest.Config {
-	var config *rest.Config
-	var err error
+func newRestConfig(kubeConfig string) (*rest.Config, error) {
 	if kubeConfig == "" {
-		config, err = rest.InClusterConfig()
+		config, err := rest.InClusterConfig()
 		if err != nil {
-			panic(err)
-		}
-	} else {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
-		if nil != err {
-			panic(err)
+			return nil, fmt.Errorf("failed to get in-cluster kube config, set -kube-config if out-of-cluster: %s", err.Error())
 		}
+		return config, nil
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kube config %s: %s", kubeConfig, err.Error())
 	}
-	return config
+	return config, nil
 }
 
-func newKubeClient(kubeConfig string) *kubernetes.Clientset {
-	config := newRestConfig(kubeConfig)
+// the k8s clients are built once for each kubeConfig, and shared by the runs, i.e. the reconciles in daemon mode.
+var (
+	k8sClientsLock sync.Mutex
+	kubeClients    = map[string]*kubernetes.Clientset{}
+	calicoClients  = map[string]*dynamic.DynamicClient{}
+)
+
+func kubeClientOf(kubeConfig string) (*kubernetes.Clientset, error) {
+	k8sClientsLock.Lock()
+	defer k8sClientsLock.Unlock()
+	if client, ok := kubeClients[kubeConfig]; ok {
+		return client, nil
+	}
+	config, err := newRestConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		return nil, fmt.Errorf("failed to create k8s client: %s", err.Error())
 	}
-	return client
+	kubeClients[kubeConfig] = client
+	return client, nil
 }
 
-func newCalicoClient(kubeConfig string) *dynamic.DynamicClient {
-	config := newRestConfig(kubeConfig)
+func calicoClientOf(kubeConfig string) (*dynamic.DynamicClient, error) {
+	k8sClientsLock.Lock()
+	defer k8sClientsLock.Unlock()
+	if client, ok := calicoClients[kubeConfig]; ok {
+		return client, nil
+	}
+	config, err := newRestConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
 	client, err := dynamic.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		return nil, fmt.Errorf("failed to create calico client: %s", err.Error())
 	}
-	return client
+	calicoClients[kubeConfig] = client
+	return client, nil
 }
 
-func macAddrOfTunnel(bc *f5_bigip.BIGIPContext, name string) (string, error) {
+// macAddrOfTunnel reads the MAC address of the tunnel from its stats, which, unlike tmsh by util/bash,
+// is permitted to the roles other than Administrator.
+func macAddrOfTunnel(bc *f5_bigip.BIGIPContext, partition, name string) (string, error) {
 	slog := utils.LogFromContext(bc.Context)
-	// modify sys db tmrouted.tmos.routing value enable
-	cmd := fmt.Sprintf(`show net tunnels tunnel %s all-properties`, name)
-	slog.Debugf("tmsh cmd: %s", cmd)
+	kind := "net/tunnels/tunnel/" + utils.Refname(partition, "", name) + "/stats"
 
-	reMac := regexp.MustCompile("(?:[0-9a-fA-F]:?){12}")
+	reMac := regexp.MustCompile("^(?:[0-9a-fA-F]{1,2}:){5}[0-9a-fA-F]{1,2}$")
 
 	for times, waits := 30, time.Millisecond*100; times > 0; times-- {
-		if resp, err := bc.Tmsh(cmd); err != nil {
-			return "", err
-		} else {
-			if rlt, ok := (*resp)["commandResult"]; ok {
-				macAddress := reMac.FindString(rlt.(string))
-				if macAddress == "" {
-					slog.Warnf("not found macAddress from %s", (*resp)["commandResult"].(string))
-				} else {
-					slog.Debugf("got tunnel %s macAddress: %s", name, macAddress)
-					return macAddress, nil
-				}
-			} else {
-				slog.Warnf("empty response from tmsh '%s', no macAddress retrived", cmd)
-			}
-			<-time.After(waits)
+		resp, err := bc.All(kind)
+		if err != nil {
+			return "", countRestError(bc, "net/tunnels/tunnel", err)
 		}
+		macAddress := ""
+		// the stats are in entries.<self link>.nestedStats.entries.macAddr.description
+		entries, _ := (*resp)["entries"].(map[string]interface{})
+		for _, entry := range entries {
+			stats, _ := entry.(map[string]interface{})["nestedStats"].(map[string]interface{})
+			statsEntries, _ := stats["entries"].(map[string]interface{})
+			macAddr, _ := statsEntries["macAddr"].(map[string]interface{})
+			macAddress, _ = macAddr["description"].(string)
+		}
+		if reMac.MatchString(macAddress) {
+			slog.Debugf("got tunnel %s macAddress: %s", name, macAddress)
+			return macAddress, nil
+		}
+		slog.Warnf("no macAddress in the stats of tunnel %s yet: '%s'", name, macAddress)
+		tunnelMacRetriesTotal.WithLabelValues(bc.URL).Inc()
+		<-time.After(waits)
 	}
 
 	return "", fmt.Errorf("timeout for getting tunnel mac address")
 }
 
-func allNodeIpAddrs(ctx context.Context, ns *v1.NodeList) []string {
-	rlt := []string{}
+// modifyDbValue sets the db key by PATCH sys/db/<key>, instead of tmsh by util/bash which requires Administrator.
+// f5-bigip-rest-go has no call for the objects without partition, so it's sent with the client of the connection.
+func modifyDbValue(bc *f5_bigip.BIGIPContext, name, value string) error {
+	conn, ok := bc.Context.Value(connKey{}).(*bigipConn)
+	if !ok {
+		return fmt.Errorf("no connection to BIG-IP %s", bc.URL)
+	}
+	body, _ := json.Marshal(map[string]string{"value": value})
+	req, err := http.NewRequestWithContext(bc.Context, "PATCH", bc.URL+"/mgmt/tm/sys/db/"+name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bc.Authorization != "" {
+		req.Header.Set("Authorization", bc.Authorization)
+	}
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		return countRestError(bc, "sys/db", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bresp, _ := io.ReadAll(resp.Body)
+		return countRestError(bc, "sys/db", fmt.Errorf("failed to modify db %s: %d, %s", name, resp.StatusCode, bresp))
+	}
+	return nil
+}
+
+// allNodeIpAddrs returns the sorted IPv4 and IPv6 addresses of the nodes.
+func allNodeIpAddrs(ctx context.Context, ns *v1.NodeList) ([]string, []string) {
+	rlt4, rlt6 := []string{}, []string{}
 	ipv4, ipv6 := allNodeIPMacAddrs(ctx, ns)
 	for k := range ipv4 {
-		rlt = append(rlt, k)
+		rlt4 = append(rlt4, k)
 	}
 	for k := range ipv6 {
-		rlt = append(rlt, k)
+		rlt6 = append(rlt6, k)
 	}
-	return rlt
+	sort.Strings(rlt4)
+	sort.Strings(rlt6)
+	return rlt4, rlt6
+}
+
+// selectNodes returns the nodes matching the label selector, all of them if selector is empty.
+func selectNodes(nodeList *v1.NodeList, selector string) (*v1.NodeList, error) {
+	if selector == "" {
+		return nodeList, nil
+	}
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector '%s': %s", selector, err.Error())
+	}
+	selected := &v1.NodeList{}
+	for _, n := range nodeList.Items {
+		if sel.Matches(labels.Set(n.Labels)) {
+			selected.Items = append(selected.Items, n)
+		}
+	}
+	return selected, nil
 }
 
 func nodeIsTaint(n *v1.Node) bool {
@@ -187,10 +667,16 @@ func allNodeIPMacAddrs(ctx context.Context, ns *v1.NodeList) (map[string]string,
 		ipaddrv4, ipaddrv6 := "", ""
 		macv4, macv6 := "", ""
 		// calico
-		if _, ok := n.Annotations["projectcalico.org/IPv4Address"]; ok {
+		_, calicov4 := n.Annotations["projectcalico.org/IPv4Address"]
+		_, calicov6 := n.Annotations["projectcalico.org/IPv6Address"]
+		if calicov4 || calicov6 {
 			// no mac addr found in 'kubectl get nodes -o yaml'
-			ipmask := n.Annotations["projectcalico.org/IPv4Address"]
-			ipaddrv4 = strings.Split(ipmask, "/")[0]
+			if calicov4 {
+				ipaddrv4 = strings.Split(n.Annotations["projectcalico.org/IPv4Address"], "/")[0]
+			}
+			if calicov6 {
+				ipaddrv6 = strings.Split(n.Annotations["projectcalico.org/IPv6Address"], "/")[0]
+			}
 		} else {
 			// flannel v4
 			if _, ok := n.Annotations["flannel.alpha.coreos.com/backend-data"]; ok {
@@ -202,7 +688,7 @@ func allNodeIPMacAddrs(ctx context.Context, ns *v1.NodeList) (map[string]string,
 				if err != nil {
 					slog.Errorf("failed to get mac of %s: %s", n.Name, err.Error())
 				}
-				macv4 = v["VtepMAC"].(string)
+				macv4, _ = v["VtepMAC"].(string)
 			}
 			// flannel v6
 			if _, ok := n.Annotations["flannel.alpha.coreos.com/backend-v6-data"]; ok {
@@ -213,7 +699,7 @@ func allNodeIPMacAddrs(ctx context.Context, ns *v1.NodeList) (map[string]string,
 				if err != nil {
 					slog.Errorf("failed to get mac v6 of %s: %s", n.Name, err.Error())
 				}
-				macv6 = v6["VtepMAC"].(string)
+				macv6, _ = v6["VtepMAC"].(string)
 			}
 		}
 		if ipaddrv4 != "" {
@@ -227,7 +713,10 @@ func allNodeIPMacAddrs(ctx context.Context, ns *v1.NodeList) (map[string]string,
 	return rlt4, rlt6
 }
 
+// allNodesIP2Macs returns the MACs of cilium nodes for the fdb records, which are derived
+// from the IPv4 internal addresses by ipv4ToMac, i.e. 0a:0a:0a:fa:11:dc for 10.250.17.220.
 func allNodesIP2Macs(ctx context.Context, ns *v1.NodeList) (map[string]string, map[string]string) {
+	slog := utils.LogFromContext(ctx)
 	rlt4 := map[string]string{}
 	rlt6 := map[string]string{}
 
@@ -235,23 +724,60 @@ func allNodesIP2Macs(ctx context.Context, ns *v1.NodeList) (map[string]string, m
 		addrs := n.Status.Addresses
 		ipaddr := ""
 		for _, addr := range addrs {
-			if addr.Type == v1.NodeInternalIP {
+			if addr.Type == v1.NodeInternalIP && net.ParseIP(addr.Address).To4() != nil {
 				ipaddr = addr.Address
 				break
 			}
 		}
+		if ipaddr == "" {
+			slog.Warnf("no IPv4 internal address found for node %s, skipped", n.Name)
+			continue
+		}
 		rlt4[ipaddr] = ipv4ToMac(ipaddr)
 	}
 
 	return rlt4, rlt6
 }
 
-func parseNodeConfigs(ctx context.Context, cniconf *CNIConfig, nodeList *v1.NodeList) (map[string]interface{}, error) {
+// bgpNeighbors returns the addresses of the nodes as BIG-IP bgp neighbors, and the nodes selected by neighborSelector.
+func (cniconf *CNIConfig) bgpNeighbors(ctx context.Context, nodeList *v1.NodeList) ([]string, *v1.NodeList, error) {
+	slog := utils.LogFromContext(ctx)
+	neighbors, err := selectNodes(nodeList, cniconf.Calico.NeighborSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	nIpv4s, nIpv6s := allNodeIpAddrs(ctx, neighbors)
+	// the nodes can only peer with BIG-IP over the families of peerIPs, for BGPPeers are created from them.
+	peerv4, peerv6 := false, false
+	for _, peerIP := range cniconf.Calico.PeerIPs {
+		if isIPv6(peerIP) {
+			peerv6 = true
+		} else {
+			peerv4 = true
+		}
+	}
+	if !peerv4 && len(nIpv4s) > 0 {
+		slog.Warnf("no IPv4 peerIPs configured, skipped IPv4 neighbors: %v", nIpv4s)
+		nIpv4s = []string{}
+	}
+	if !peerv6 && len(nIpv6s) > 0 {
+		slog.Warnf("no IPv6 peerIPs configured, skipped IPv6 neighbors: %v", nIpv6s)
+		nIpv6s = []string{}
+	}
+	return append(nIpv4s, nIpv6s...), neighbors, nil
+}
+
+// parseNodeConfigs generates the bgp neighbors and fdb records of the nodes,
+// rdPath is the full path of the route domain for the bgp instance, empty for the default one.
+func parseNodeConfigs(ctx context.Context, cniconf *CNIConfig, nodeList *v1.NodeList, rdPath string) (map[string]interface{}, error) {
 	cfgs := map[string]interface{}{}
 
 	if cniconf.Calico != nil {
-		nIpAddresses := allNodeIpAddrs(ctx, nodeList)
-		if ccfgs, err := parseNeighsFrom("gwcBGP", cniconf.Calico.LocalAS, cniconf.Calico.RemoteAS, nIpAddresses); err != nil {
+		nIpAddresses, _, err := cniconf.bgpNeighbors(ctx, nodeList)
+		if err != nil {
+			return map[string]interface{}{}, err
+		}
+		if ccfgs, err := cniconf.parseNeighsFrom(rdPath, nIpAddresses); err != nil {
 			return map[string]interface{}{}, err
 		} else {
 			for k, v := range ccfgs {
@@ -261,9 +787,14 @@ func parseNodeConfigs(ctx context.Context, cniconf *CNIConfig, nodeList *v1.Node
 	}
 
 	if cniconf.Flannel != nil {
-		nIpToMacV4, _ := allNodeIPMacAddrs(ctx, nodeList)
+		nIpToMacV4, nIpToMacV6 := allNodeIPMacAddrs(ctx, nodeList)
 		for _, tunnel := range cniconf.Flannel.Tunnels {
-			if fcfgs, err := parseFdbsFrom(tunnel.Name, nIpToMacV4); err != nil {
+			// the fdb records of the same family with the tunnel.
+			nIpToMac := nIpToMacV4
+			if isIPv6(tunnel.LocalAddress) {
+				nIpToMac = nIpToMacV6
+			}
+			if fcfgs, err := parseFdbsFrom(tunnel.Name, cniconf.routeDomain(), nIpToMac); err != nil {
 				return map[string]interface{}{}, err
 			} else {
 				for k, v := range fcfgs {
@@ -274,8 +805,11 @@ func parseNodeConfigs(ctx context.Context, cniconf *CNIConfig, nodeList *v1.Node
 	}
 	if cniconf.Cilium != nil {
 		nIpToMacV4, _ := allNodesIP2Macs(ctx, nodeList)
+		if err := cniconf.checkCiliumMacs(nIpToMacV4); err != nil {
+			return map[string]interface{}{}, err
+		}
 		for _, tunnel := range cniconf.Cilium.Tunnels {
-			if fcfgs, err := parseFdbsFrom(tunnel.Name, nIpToMacV4); err != nil {
+			if fcfgs, err := parseFdbsFrom(tunnel.Name, cniconf.routeDomain(), nIpToMacV4); err != nil {
 				return map[string]interface{}{}, err
 			} else {
 				for k, v := range fcfgs {
@@ -319,30 +853,89 @@ func parseSelf(name, address, vlan string) map[string]interface{} {
 	}
 }
 
-func parseNeighsFrom(routerName, localAs, remoteAs string, addresses []string) (map[string]interface{}, error) {
+// parseNeighsFrom generates the bgp instance with the nodes as neighbors, and the session settings of calico.
+func (cniconf *CNIConfig) parseNeighsFrom(rdPath string, addresses []string) (map[string]interface{}, error) {
 	rlt := map[string]interface{}{}
+	calico := cniconf.Calico
 
-	name := strings.Join([]string{"Common", routerName}, ".")
-	rlt["net/routing/bgp/"+name] = map[string]interface{}{
+	name := strings.Join([]string{cniconf.partition(), cniconf.bgpRouterName()}, ".")
+	instance := map[string]interface{}{
 		"name":     name,
-		"localAs":  localAs,
+		"localAs":  calico.LocalAS,
 		"neighbor": []interface{}{},
 	}
+	if rdPath != "" {
+		instance["routeDomain"] = rdPath
+	}
+	if gr := calico.GracefulRestart; gr != nil {
+		restart := map[string]interface{}{"gracefulReset": "enabled"}
+		if gr.RestartTime > 0 {
+			restart["restartTime"] = gr.RestartTime
+		}
+		if gr.StalePathTime > 0 {
+			restart["stalepathTime"] = gr.StalePathTime
+		}
+		instance["gracefulRestart"] = restart
+	}
+	rlt["net/routing/bgp/"+name] = instance
 
 	fmtneigs := []interface{}{}
 	for _, address := range addresses {
-		fmtneigs = append(fmtneigs, map[string]interface{}{
-			"name":     address,
-			"remoteAs": remoteAs,
-		})
+		// activate the address family of the neighbor only.
+		families := map[string]map[string]interface{}{
+			"ipv4": {"name": "ipv4", "activate": "enabled"},
+			"ipv6": {"name": "ipv6", "activate": "disabled"},
+		}
+		family := "ipv4"
+		if isIPv6(address) {
+			family = "ipv6"
+			families["ipv4"]["activate"], families["ipv6"]["activate"] = "disabled", "enabled"
+		}
+		if calico.RouteMap != nil {
+			families[family]["routeMap"] = map[string]interface{}{"in": calico.RouteMap.In, "out": calico.RouteMap.Out}
+		}
+		if calico.PrefixList != nil {
+			families[family]["prefixList"] = map[string]interface{}{"in": calico.PrefixList.In, "out": calico.PrefixList.Out}
+		}
+		neighbor := map[string]interface{}{
+			"name":          address,
+			"remoteAs":      calico.RemoteAS,
+			"addressFamily": []interface{}{families["ipv4"], families["ipv6"]},
+		}
+		if calico.bgpPassword != "" {
+			neighbor["password"] = calico.bgpPassword
+		}
+		if calico.KeepAlive > 0 || calico.HoldTime > 0 {
+			timers := map[string]interface{}{}
+			if calico.KeepAlive > 0 {
+				timers["keepAlive"] = calico.KeepAlive
+			}
+			if calico.HoldTime > 0 {
+				timers["holdTime"] = calico.HoldTime
+			}
+			neighbor["timers"] = timers
+		}
+		if calico.EbgpMultihop > 0 {
+			neighbor["ebgpMultihop"] = calico.EbgpMultihop
+		}
+		if calico.BFD {
+			hop := "single-hop"
+			if calico.EbgpMultihop > 1 {
+				hop = "multi-hop"
+			}
+			neighbor["fallOver"] = map[string]interface{}{
+				"bfd": map[string]interface{}{"enabled": true, "type": hop},
+			}
+		}
+		fmtneigs = append(fmtneigs, neighbor)
 	}
 
-	rlt["net/routing/bgp/"+name].(map[string]interface{})["neighbor"] = fmtneigs
+	instance["neighbor"] = fmtneigs
 
 	return rlt, nil
 }
 
-func parseFdbsFrom(tunnelName string, iPToMac map[string]string) (map[string]interface{}, error) {
+func parseFdbsFrom(tunnelName string, routeDomain int, iPToMac map[string]string) (map[string]interface{}, error) {
 	rlt := map[string]interface{}{}
 
 	rlt["net/fdb/tunnel/"+tunnelName] = map[string]interface{}{
@@ -353,7 +946,7 @@ func parseFdbsFrom(tunnelName string, iPToMac map[string]string) (map[string]int
 	for ip, mac := range iPToMac {
 		fmtrecords = append(fmtrecords, map[string]string{
 			"name":     mac,
-			"endpoint": ip,
+			"endpoint": withRouteDomain(ip, routeDomain),
 		})
 	}
 
@@ -362,6 +955,77 @@ func parseFdbsFrom(tunnelName string, iPToMac map[string]string) (map[string]int
 	return rlt, nil
 }
 
+// withRouteDomain appends the route domain id to the address, i.e. 10.1.1.1%2/24, 10.1.1.1%2
+func withRouteDomain(addr string, routeDomain int) string {
+	if routeDomain == 0 {
+		return addr
+	}
+	ipmask := strings.SplitN(addr, "/", 2)
+	ipmask[0] = fmt.Sprintf("%s%%%d", ipmask[0], routeDomain)
+	return strings.Join(ipmask, "/")
+}
+
+// checkCiliumMacs makes sure the node MACs and the tunnel MACs are valid unicast addresses without conflicts,
+// otherwise the vxlan traffic between BIG-IP and cilium nodes would be dropped silently.
+func (cniconf *CNIConfig) checkCiliumMacs(ipToMac map[string]string) error {
+	macs := map[string]string{}
+	for _, tunnel := range cniconf.Cilium.Tunnels {
+		// not fetched yet, i.e. in uninstall mode, or placeholders in dry-run mode.
+		if tunnel.tunnelMac == "" || strings.HasPrefix(tunnel.tunnelMac, "<") {
+			continue
+		}
+		if err := checkUnicastMac(tunnel.tunnelMac); err != nil {
+			return fmt.Errorf("invalid mac of cilium tunnel %s: %s", tunnel.Name, err.Error())
+		}
+		macs[strings.ToLower(tunnel.tunnelMac)] = "tunnel " + tunnel.Name
+	}
+	for ip, mac := range ipToMac {
+		if err := checkUnicastMac(mac); err != nil {
+			return fmt.Errorf("invalid mac of cilium node %s: %s", ip, err.Error())
+		}
+		if owner, ok := macs[mac]; ok {
+			return fmt.Errorf("mac %s of cilium node %s conflicts with %s", mac, ip, owner)
+		}
+		macs[mac] = "node " + ip
+	}
+	return nil
+}
+
+func checkUnicastMac(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if len(hw) != 6 || hw[0]&0x01 != 0 {
+		return fmt.Errorf("%s is not a unicast ethernet address", mac)
+	}
+	return nil
+}
+
+func isIPv6(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// normalizedIP returns the canonical form of the address, i.e. 2001:db8::dc for 2001:0DB8:0:0:0:0:0:DC,
+// or the address as it is if invalid.
+func normalizedIP(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// dnsLabelOf returns the address as a part of k8s object names, i.e. 2001-db8--dc for 2001:db8::dc,
+// with 0 appended for the addresses ending with "::", which must end with an alphanumeric character.
+func dnsLabelOf(addr string) string {
+	label := strings.ReplaceAll(normalizedIP(addr), ":", "-")
+	if strings.HasSuffix(label, "-") {
+		label += "0"
+	}
+	return label
+}
+
 // Convert an IPV4 string to a fake MAC address.
 func ipv4ToMac(addr string) string {
 	ip := strings.Split(addr, ".")
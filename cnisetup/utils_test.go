@@ -0,0 +1,289 @@
+package cnisetup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTunnelMacAndDbValue(t *testing.T) {
+	patched := map[string]interface{}{}
+	c := fakeBIGIP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/mgmt/tm/net/tunnels/tunnel/~k8s~fl-tunnel/stats":
+			io.WriteString(w, `{"entries": {"https://localhost/mgmt/tm/net/tunnels/tunnel/~k8s~fl-tunnel/~k8s~fl-tunnel/stats": {
+				"nestedStats": {"entries": {"macAddr": {"description": "00:50:56:86:6e:b4"}, "name": {"description": "/k8s/fl-tunnel"}}}}}}`)
+		case r.Method == "PATCH" && r.URL.Path == "/mgmt/tm/sys/db/tmrouted.tmos.routing":
+			json.NewDecoder(r.Body).Decode(&patched)
+			io.WriteString(w, `{}`)
+		case r.Method == "GET" && r.URL.Path == "/mgmt/tm/sys/version":
+			io.WriteString(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code": 404}`)
+		}
+	})
+	bc, err := c.newBIGIPContext(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mac, err := macAddrOfTunnel(bc, "k8s", "fl-tunnel"); err != nil || mac != "00:50:56:86:6e:b4" {
+		t.Errorf("macAddrOfTunnel: got '%s', %v", mac, err)
+	}
+	if _, err := macAddrOfTunnel(bc, "k8s", "no-tunnel"); err == nil {
+		t.Errorf("macAddrOfTunnel: no error for the tunnel not found")
+	}
+
+	if err := modifyDbValue(bc, "tmrouted.tmos.routing", "enable"); err != nil {
+		t.Fatal(err)
+	}
+	if patched["value"] != "enable" {
+		t.Errorf("modifyDbValue: got body %v", patched)
+	}
+	if err := modifyDbValue(bc, "no.such.key", "enable"); err == nil {
+		t.Errorf("modifyDbValue: no error for the key not found")
+	}
+}
+
+// fakeObjects serves the objects of BIG-IP in memory by path, i.e. /mgmt/tm/sys/folder/~k8s,
+// and fails deleting the paths in busy, like the partitions with objects.
+func fakeObjects(t *testing.T, objects map[string]map[string]interface{}, busy map[string]bool) *CNIConfig {
+	var lock sync.Mutex
+	return fakeBIGIP(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		path := r.URL.Path
+		if r.Method == "POST" {
+			name, _ := body["name"].(string)
+			partition, _ := body["partition"].(string)
+			path += "/~" + strings.TrimPrefix(partition+"~"+name, "/~")
+		}
+		obj, found := objects[path]
+		switch {
+		case r.Method == "GET" && found:
+			json.NewEncoder(w).Encode(obj)
+		case r.Method == "POST" && !found:
+			objects[path] = body
+			json.NewEncoder(w).Encode(body)
+		case r.Method == "PATCH" && found:
+			for k, v := range body {
+				obj[k] = v
+			}
+			json.NewEncoder(w).Encode(obj)
+		case r.Method == "DELETE" && found && busy[path]:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"code": 400, "message": "folder is not empty"}`)
+		case r.Method == "DELETE" && found:
+			delete(objects, path)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code": 404}`)
+		}
+	})
+}
+
+func TestDeployAndDeletePartitions(t *testing.T) {
+	objects := map[string]map[string]interface{}{
+		"/mgmt/tm/sys/version":       {},
+		"/mgmt/tm/sys/folder/~other": {},
+	}
+	busy := map[string]bool{"/mgmt/tm/sys/folder/~k8s": true}
+	c := fakeObjects(t, objects, busy)
+	bc, err := c.newBIGIPContext(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnictx := &CNIContext{Context: context.TODO()}
+
+	for _, name := range []string{"Common", "k8s", "k8s", "other"} {
+		if err := deployPartition(bc, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created, err := createdPartitionsOf(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cis-c-tenant", "k8s"}; !reflect.DeepEqual(created, want) {
+		t.Errorf("created partitions: got %v, want %v", created, want)
+	}
+
+	cases := []struct {
+		name        string
+		uninstalled map[string]bool
+		busy        bool
+		remaining   []string
+	}{
+		{name: "not uninstalled", uninstalled: map[string]bool{"other": true}, busy: false,
+			remaining: []string{"cis-c-tenant", "k8s", "other"}},
+		{name: "not empty", uninstalled: map[string]bool{"k8s": true}, busy: true,
+			remaining: []string{"cis-c-tenant", "k8s", "other"}},
+		{name: "empty", uninstalled: map[string]bool{"k8s": true}, busy: false,
+			remaining: []string{"other"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			busy["/mgmt/tm/sys/folder/~k8s"] = tc.busy
+			if err := cnictx.deletePartitions(bc, tc.uninstalled); err != nil {
+				t.Fatal(err)
+			}
+			remaining := []string{}
+			for _, name := range []string{"cis-c-tenant", "k8s", "other"} {
+				if _, ok := objects["/mgmt/tm/sys/folder/~"+name]; ok {
+					remaining = append(remaining, name)
+				}
+			}
+			if !reflect.DeepEqual(remaining, tc.remaining) {
+				t.Errorf("got partitions %v, want %v", remaining, tc.remaining)
+			}
+		})
+	}
+	if _, ok := objects["/mgmt/tm/ltm/data-group/internal/~cis-c-tenant~f5-kic_"+stateKeyPartitions]; ok {
+		t.Errorf("the record of the created partitions is not deleted")
+	}
+}
+
+func TestParseNeighsFrom(t *testing.T) {
+	family := func(name, activate string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "activate": activate}
+	}
+	cases := []struct {
+		name     string
+		calico   string
+		password string
+		address  string
+		instance map[string]interface{}
+		neighbor map[string]interface{}
+	}{
+		{
+			name:     "ipv4",
+			calico:   "calico: {localAS: 64512, remoteAS: 64513}",
+			address:  "10.250.17.111",
+			instance: map[string]interface{}{"name": "Common.gwcBGP", "localAs": "64512"},
+			neighbor: map[string]interface{}{"name": "10.250.17.111", "remoteAs": "64513",
+				"addressFamily": []interface{}{family("ipv4", "enabled"), family("ipv6", "disabled")}},
+		},
+		{
+			name:     "ipv6 with route map",
+			calico:   "calico: {localAS: 64512, remoteAS: 64512, routeMap: {in: rm-in, out: rm-out}}",
+			address:  "fd00::111",
+			instance: map[string]interface{}{"name": "Common.gwcBGP", "localAs": "64512"},
+			neighbor: map[string]interface{}{"name": "fd00::111", "remoteAs": "64512",
+				"addressFamily": []interface{}{family("ipv4", "disabled"), map[string]interface{}{
+					"name": "ipv6", "activate": "enabled", "routeMap": map[string]interface{}{"in": "rm-in", "out": "rm-out"}}}},
+		},
+		{
+			name:     "timers and password",
+			calico:   "calico: {localAS: 64512, remoteAS: 64512, keepAlive: 10, holdTime: 30}",
+			password: "bgp-secret",
+			address:  "10.250.17.111",
+			instance: map[string]interface{}{"name": "Common.gwcBGP", "localAs": "64512"},
+			neighbor: map[string]interface{}{"name": "10.250.17.111", "remoteAs": "64512", "password": "bgp-secret",
+				"timers":        map[string]interface{}{"keepAlive": 10, "holdTime": 30},
+				"addressFamily": []interface{}{family("ipv4", "enabled"), family("ipv6", "disabled")}},
+		},
+		{
+			name:     "bfd multi-hop",
+			calico:   "calico: {localAS: 64512, remoteAS: 64513, ebgpMultihop: 2, bfd: true}",
+			address:  "10.250.17.111",
+			instance: map[string]interface{}{"name": "Common.gwcBGP", "localAs": "64512"},
+			neighbor: map[string]interface{}{"name": "10.250.17.111", "remoteAs": "64513", "ebgpMultihop": 2,
+				"fallOver":      map[string]interface{}{"bfd": map[string]interface{}{"enabled": true, "type": "multi-hop"}},
+				"addressFamily": []interface{}{family("ipv4", "enabled"), family("ipv6", "disabled")}},
+		},
+		{
+			name:    "graceful restart in partition",
+			calico:  "partition: k8s\nbgpRouterName: r1\ncalico: {localAS: 64512, remoteAS: 64512, gracefulRestart: {restartTime: 120}}",
+			address: "10.250.17.111",
+			instance: map[string]interface{}{"name": "k8s.r1", "localAs": "64512",
+				"gracefulRestart": map[string]interface{}{"gracefulReset": "enabled", "restartTime": 120}},
+			neighbor: map[string]interface{}{"name": "10.250.17.111", "remoteAs": "64512",
+				"addressFamily": []interface{}{family("ipv4", "enabled"), family("ipv6", "disabled")}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := configOf(t, tc.calico)
+			c.Calico.bgpPassword = tc.password
+			cfgs, err := c.parseNeighsFrom("", []string{tc.address})
+			if err != nil {
+				t.Fatal(err)
+			}
+			instance, ok := cfgs["net/routing/bgp/"+tc.instance["name"].(string)].(map[string]interface{})
+			if !ok {
+				t.Fatalf("bgp instance %s not found in %v", tc.instance["name"], cfgs)
+			}
+			neighbors := instance["neighbor"].([]interface{})
+			delete(instance, "neighbor")
+			if !reflect.DeepEqual(instance, tc.instance) {
+				t.Errorf("instance: got %v, want %v", instance, tc.instance)
+			}
+			if len(neighbors) != 1 || !reflect.DeepEqual(neighbors[0], tc.neighbor) {
+				t.Errorf("neighbors: got %v, want %v", neighbors, tc.neighbor)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cases := []struct {
+		name string
+		v    interface{}
+		want interface{}
+	}{
+		{name: "not a map", v: "password", want: "password"},
+		{name: "password", v: map[string]interface{}{"name": "10.250.17.111", "password": "bgp-secret"},
+			want: map[string]interface{}{"name": "10.250.17.111", "password": "******"}},
+		{name: "nested in lists", v: map[string]interface{}{"neighbor": []interface{}{
+			map[string]interface{}{"name": "10.250.17.111", "password": "bgp-secret"},
+			map[string]interface{}{"name": "10.250.17.112"},
+		}}, want: map[string]interface{}{"neighbor": []interface{}{
+			map[string]interface{}{"name": "10.250.17.111", "password": "******"},
+			map[string]interface{}{"name": "10.250.17.112"},
+		}}},
+		// the reference to the secret of BGPPeers is no secret.
+		{name: "secret reference", v: map[string]interface{}{"password": map[string]interface{}{"secretKeyRef": map[string]interface{}{"name": "bgp"}}},
+			want: map[string]interface{}{"password": map[string]interface{}{"secretKeyRef": map[string]interface{}{"name": "bgp"}}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before, _ := json.Marshal(tc.v)
+			if got := redacted(tc.v); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			if after, _ := json.Marshal(tc.v); string(after) != string(before) {
+				t.Errorf("the original is modified: %s", after)
+			}
+		})
+	}
+}
+
+func TestWithRouteDomain(t *testing.T) {
+	cases := []struct {
+		addr        string
+		routeDomain int
+		want        string
+	}{
+		{addr: "10.250.17.219", routeDomain: 0, want: "10.250.17.219"},
+		{addr: "10.250.17.219", routeDomain: 2, want: "10.250.17.219%2"},
+		{addr: "10.42.20.1/16", routeDomain: 2, want: "10.42.20.1%2/16"},
+		{addr: "2001:db8::219", routeDomain: 65534, want: "2001:db8::219%65534"},
+		{addr: "fd00:42::1/56", routeDomain: 3, want: "fd00:42::1%3/56"},
+		{addr: "fd00:42::1/56", routeDomain: 0, want: "fd00:42::1/56"},
+	}
+	for _, tc := range cases {
+		if got := withRouteDomain(tc.addr, tc.routeDomain); got != tc.want {
+			t.Errorf("withRouteDomain(%s, %d): got %s, want %s", tc.addr, tc.routeDomain, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,625 @@
+package cnisetup
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ConfigError is a problem found in the configuration file, Line is 0 if unknown,
+// and Entry is the index of the configuration entry, -1 if not related to any entry.
+type ConfigError struct {
+	Entry   int    `json:"entry"`
+	Line    int    `json:"line"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type ConfigErrors []ConfigError
+
+// rePartition matches the BIG-IP object names, i.e. partitions and bgp instances.
+var rePartition = regexp.MustCompile(`^[a-zA-Z][\w.-]*$`)
+
+// ValidationReport is the result of validating a configuration file, grouped by entry.
+type ValidationReport struct {
+	Valid   bool          `json:"valid"`
+	Entries []EntryReport `json:"entries"`
+	Errors  ConfigErrors  `json:"errors"`
+}
+
+type EntryReport struct {
+	Index     int          `json:"index"`
+	IpAddress string       `json:"ipAddress"`
+	Valid     bool         `json:"valid"`
+	Errors    ConfigErrors `json:"errors"`
+}
+
+func (ce ConfigError) Error() string {
+	return fmt.Sprintf("line %d: %s: %s", ce.Line, ce.Path, ce.Message)
+}
+
+func (ces ConfigErrors) Error() string {
+	msgs := []string{}
+	for _, ce := range ces {
+		msgs = append(msgs, ce.Error())
+	}
+	return fmt.Sprintf("%d problem(s) found in configuration:\n  %s", len(ces), strings.Join(msgs, "\n  "))
+}
+
+// Validate loads and validates the configuration file only, without credentials or any connection,
+// it returns error only if the file cannot be read or parsed.
+func (cniconfs *CNIConfigs) Validate(configPath string) (*ValidationReport, error) {
+	errs := ConfigErrors{}
+	if err := getConfigs(cniconfs, configPath); err != nil {
+		ces, ok := err.(ConfigErrors)
+		if !ok {
+			return nil, err
+		}
+		errs = ces
+	}
+
+	report := ValidationReport{Valid: len(errs) == 0, Entries: []EntryReport{}, Errors: ConfigErrors{}}
+	for i, c := range *cniconfs {
+		report.Entries = append(report.Entries, EntryReport{
+			Index:     i,
+			IpAddress: c.Management.IpAddress,
+			Valid:     true,
+			Errors:    ConfigErrors{},
+		})
+	}
+	for _, ce := range errs {
+		if ce.Entry >= 0 && ce.Entry < len(report.Entries) {
+			report.Entries[ce.Entry].Valid = false
+			report.Entries[ce.Entry].Errors = append(report.Entries[ce.Entry].Errors, ce)
+		} else {
+			report.Errors = append(report.Errors, ce)
+		}
+	}
+	return &report, nil
+}
+
+type configValidator struct {
+	root *yaml.Node
+	errs ConfigErrors
+}
+
+// syntaxErrors converts the yaml syntax error, i.e. "yaml: line 9: mapping values are not allowed in this context",
+// to ConfigErrors, so that it is reported the same as the others.
+func syntaxErrors(err error) ConfigErrors {
+	reLine := regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	ce := ConfigError{Entry: -1, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+	if m := reLine.FindStringSubmatch(err.Error()); m != nil {
+		ce.Line, _ = strconv.Atoi(m[1])
+		ce.Message = m[2]
+	}
+	return ConfigErrors{ce}
+}
+
+// typeErrors converts the errors from strict yaml decoding, i.e. unknown fields, to ConfigErrors.
+func typeErrors(root *yaml.Node, te *yaml.TypeError) ConfigErrors {
+	reLine := regexp.MustCompile(`^line (\d+): (.*)$`)
+	reField := regexp.MustCompile(`^field (\S+) not found in type .*$`)
+	errs := ConfigErrors{}
+	for _, e := range te.Errors {
+		ce := ConfigError{Entry: -1, Message: e}
+		if m := reLine.FindStringSubmatch(e); m != nil {
+			ce.Line, _ = strconv.Atoi(m[1])
+			ce.Message = m[2]
+			ce.Entry = yamlEntry(root, ce.Line)
+		}
+		if m := reField.FindStringSubmatch(ce.Message); m != nil {
+			ce.Path = m[1]
+			if path := yamlKeyPath(root, ce.Line, m[1]); path != nil {
+				ce.Path = pathString(path)
+			}
+			ce.Message = "unknown field"
+		}
+		errs = append(errs, ce)
+	}
+	return errs
+}
+
+// validateConfigs checks the syntax of addresses, AS numbers, and the references between
+// configuration items, root is the parsed yaml document for locating the line numbers.
+func validateConfigs(root *yaml.Node, cniconfs CNIConfigs) ConfigErrors {
+	v := &configValidator{root: root, errs: ConfigErrors{}}
+	if len(cniconfs) == 0 {
+		v.errorf([]interface{}{}, "no BIG-IP configured")
+	}
+	for i, c := range cniconfs {
+		v.validateConfig([]interface{}{i}, &c)
+	}
+
+	// the entries of the same BIG-IP and partition share one connection, built from the management of the first one.
+	firsts := map[string]int{}
+	for i := range cniconfs {
+		c := &cniconfs[i]
+		key := fmt.Sprintf("%s:%d/%s", normalizedIP(c.Management.IpAddress), managementPort(c), c.partition())
+		if j, ok := firsts[key]; !ok {
+			firsts[key] = i
+		} else if !sameManagement(&cniconfs[j], c) {
+			v.errorf([]interface{}{i, "management"}, "differs from entry %d of the same BIG-IP and partition, which share one connection", j)
+		}
+	}
+
+	// the objects of the same BIG-IP and partition are deployed together, the ones of the same kind and name overwrite each other.
+	defined := map[string]configObject{}
+	for i := range cniconfs {
+		c := &cniconfs[i]
+		group := fmt.Sprintf("%s:%d/%s", normalizedIP(c.Management.IpAddress), managementPort(c), c.partition())
+		for _, obj := range objectsOf(i, c) {
+			key := group + "/" + obj.kind + "/" + obj.name
+			if first, ok := defined[key]; !ok {
+				defined[key] = obj
+			} else if obj.spec == "" || obj.spec != first.spec {
+				v.errorf(obj.path, "duplicate %s name '%s' on the same BIG-IP and partition, also defined at %s",
+					obj.kind, obj.name, pathString(first.path))
+			}
+		}
+	}
+	return v.errs
+}
+
+// configObject is a BIG-IP object defined by a configuration entry, located by path.
+type configObject struct {
+	kind string
+	name string
+	// spec tells whether the objects of the same name are the same, i.e. a vxlan profile shared by tunnels,
+	// empty for the ones never shared.
+	spec string
+	path []interface{}
+}
+
+// objectsOf returns the BIG-IP objects of the entry i, keyed by name in the deployment, see applyToBIGIPs.
+func objectsOf(i int, c *CNIConfig) []configObject {
+	objs := []configObject{}
+	addTunnels := func(cni string, floodingType string, names, profiles []string, ports []int) {
+		for j := range names {
+			objs = append(objs,
+				configObject{kind: "vxlan profile", name: profiles[j], spec: fmt.Sprintf("%s:%d", floodingType, ports[j]),
+					path: []interface{}{i, cni, "tunnels", j, "profileName"}},
+				configObject{kind: "tunnel", name: names[j], path: []interface{}{i, cni, "tunnels", j, "name"}})
+		}
+	}
+	addSelfIPs := func(cni string, selfIPs []BIGIPSelfIP) {
+		for j, selfIP := range selfIPs {
+			objs = append(objs, configObject{kind: "self IP", name: selfIP.Name, path: []interface{}{i, cni, "selfIPs", j, "name"}})
+		}
+	}
+	if c.Flannel != nil {
+		names, profiles, ports := []string{}, []string{}, []int{}
+		for _, t := range c.Flannel.Tunnels {
+			names, profiles, ports = append(names, t.Name), append(profiles, t.ProfileName), append(ports, t.Port)
+		}
+		addTunnels("flannel", "none", names, profiles, ports)
+		addSelfIPs("flannel", c.Flannel.SelfIPs)
+	}
+	if c.Calico != nil {
+		addSelfIPs("calico", c.Calico.SelfIPs)
+		objs = append(objs, configObject{kind: "bgp instance", name: c.bgpRouterName(), path: []interface{}{i, "bgpRouterName"}})
+	}
+	if c.Cilium != nil {
+		names, profiles, ports := []string{}, []string{}, []int{}
+		for _, t := range c.Cilium.Tunnels {
+			names, profiles, ports = append(names, t.Name), append(profiles, t.ProfileName), append(ports, t.Port)
+		}
+		addTunnels("cilium", "multipoint", names, profiles, ports)
+		addSelfIPs("cilium", c.Cilium.SelfIPs)
+		for j, route := range c.Cilium.Routes {
+			objs = append(objs, configObject{kind: "route", name: strings.Split(route.Network, "/")[0],
+				path: []interface{}{i, "cilium", "routes", j, "network"}})
+		}
+	}
+	return objs
+}
+
+func managementPort(c *CNIConfig) int {
+	if c.Management.Port == nil {
+		return 443
+	}
+	return *c.Management.Port
+}
+
+// sameManagement tells whether the management blocks, i.e. the credential sources and TLS settings, are the same.
+func sameManagement(a, b *CNIConfig) bool {
+	ma, mb := a.Management, b.Management
+	ma.Port, mb.Port = nil, nil
+	ma.password, mb.password = "", ""
+	ma.IpAddress, mb.IpAddress = normalizedIP(ma.IpAddress), normalizedIP(mb.IpAddress)
+	return managementPort(a) == managementPort(b) && reflect.DeepEqual(ma, mb)
+}
+
+func (v *configValidator) validateConfig(path []interface{}, c *CNIConfig) {
+	mpath := subpath(path, "management")
+	if c.Management.Username == "" && (c.Management.SecretRef == nil || c.Management.SecretRef.UsernameKey == "") {
+		v.errorf(subpath(mpath, "username"), "username is required")
+	}
+	if net.ParseIP(c.Management.IpAddress) == nil {
+		v.errorf(subpath(mpath, "ipAddress"), "invalid IP address '%s'", c.Management.IpAddress)
+	}
+	if c.Management.Port != nil {
+		v.checkPort(subpath(mpath, "port"), *c.Management.Port)
+	}
+	sources := 0
+	for _, configured := range []bool{c.Management.PasswordFile != "", c.Management.PasswordEnv != "", c.Management.SecretRef != nil} {
+		if configured {
+			sources++
+		}
+	}
+	if sources > 1 {
+		v.errorf(mpath, "at most one of passwordFile, passwordEnv and secretRef can be configured")
+	}
+	switch c.Management.AuthType {
+	case "", "basic":
+		if c.Management.LoginProviderName != "" {
+			v.errorf(subpath(mpath, "loginProviderName"), "loginProviderName requires authType token")
+		}
+	case "token":
+	default:
+		v.errorf(subpath(mpath, "authType"), "invalid authType '%s', should be basic or token", c.Management.AuthType)
+	}
+	if c.Management.InsecureSkipVerify && (c.Management.CaFile != "" || c.Management.CaBundle != "" || c.Management.ServerName != "") {
+		v.errorf(subpath(mpath, "insecureSkipVerify"), "insecureSkipVerify conflicts with caFile, caBundle and serverName")
+	}
+	if c.Management.CaBundle != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(c.Management.CaBundle)) {
+		v.errorf(subpath(mpath, "caBundle"), "no PEM certificate found")
+	}
+	if ref := c.Management.SecretRef; ref != nil {
+		if ref.Namespace == "" {
+			v.errorf(subpath(mpath, "secretRef", "namespace"), "namespace is required")
+		}
+		if ref.Name == "" {
+			v.errorf(subpath(mpath, "secretRef", "name"), "name is required")
+		}
+	}
+	if c.Partition != "" && !rePartition.MatchString(c.Partition) {
+		v.errorf(subpath(path, "partition"), "invalid partition name '%s'", c.Partition)
+	}
+	if c.RouteDomain != nil && (*c.RouteDomain < 0 || *c.RouteDomain > 65534) {
+		v.errorf(subpath(path, "routeDomain"), "invalid route domain %d, should be in range 0-65534", *c.RouteDomain)
+	}
+	if c.BgpRouterName != "" && !rePartition.MatchString(c.BgpRouterName) {
+		v.errorf(subpath(path, "bgpRouterName"), "invalid bgpRouterName '%s'", c.BgpRouterName)
+	}
+	if c.Flannel == nil && c.Calico == nil && c.Cilium == nil {
+		v.errorf(path, "none of flannel, calico or cilium is configured")
+	}
+
+	if c.Flannel != nil {
+		fpath := subpath(path, "flannel")
+		tunnels := map[string]string{}
+		for i, t := range c.Flannel.Tunnels {
+			v.checkTunnel(subpath(fpath, "tunnels", i), t.Name, t.ProfileName, t.LocalAddress, t.Port)
+			tunnels[t.Name] = t.LocalAddress
+		}
+		tunnelNets := v.checkSelfIPs(subpath(fpath, "selfIPs"), c.Flannel.SelfIPs, tunnels)
+		for i, nc := range c.Flannel.NodeConfigs {
+			npath := subpath(fpath, "nodeConfigs", i)
+			if nc.PublicIP == "" && nc.PublicIPv6 == "" {
+				v.errorf(npath, "at least one of publicIP and publicIPv6 is required")
+			}
+			if nc.PublicIP != "" || nc.PodCIDR != "" {
+				v.checkNodeConfig(npath, "publicIP", "podCIDR", nc.PublicIP, nc.PodCIDR, false, tunnels, tunnelNets)
+			}
+			if nc.PublicIPv6 != "" || nc.PodCIDRv6 != "" {
+				v.checkNodeConfig(npath, "publicIPv6", "podCIDRv6", nc.PublicIPv6, nc.PodCIDRv6, true, tunnels, tunnelNets)
+			}
+			if net.ParseIP(nc.PublicIP) != nil || (nc.PublicIP == "" && net.ParseIP(nc.PublicIPv6) != nil) {
+				v.checkName(npath, "node", nc.nodeName())
+			}
+		}
+	}
+
+	if c.Calico != nil {
+		cpath := subpath(path, "calico")
+		v.checkAS(subpath(cpath, "localAS"), c.Calico.LocalAS)
+		v.checkAS(subpath(cpath, "remoteAS"), c.Calico.RemoteAS)
+		v.checkSelfIPs(subpath(cpath, "selfIPs"), c.Calico.SelfIPs, map[string]string{})
+		for field, cidrs := range map[string][]string{
+			"serviceClusterIPs":      c.Calico.ServiceClusterIPs,
+			"serviceExternalIPs":     c.Calico.ServiceExternalIPs,
+			"serviceLoadBalancerIPs": c.Calico.ServiceLoadBalancerIPs,
+		} {
+			for i, cidr := range cidrs {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					v.errorf(subpath(cpath, field, i), "invalid CIDR '%s'", cidr)
+				}
+			}
+		}
+		if c.Calico.NeighborSelector != "" {
+			if _, err := labels.Parse(c.Calico.NeighborSelector); err != nil {
+				v.errorf(subpath(cpath, "neighborSelector"), "invalid label selector '%s': %s", c.Calico.NeighborSelector, err.Error())
+			}
+		}
+		if ref := c.Calico.PasswordSecretRef; ref != nil {
+			if ref.Namespace == "" {
+				v.errorf(subpath(cpath, "passwordSecretRef", "namespace"), "namespace is required")
+			}
+			if ref.Name == "" {
+				v.errorf(subpath(cpath, "passwordSecretRef", "name"), "name is required")
+			}
+		}
+		if c.Calico.KeepAlive < 0 || c.Calico.KeepAlive > 65535 {
+			v.errorf(subpath(cpath, "keepAlive"), "invalid keepAlive %d, should be 0 (unset) or in range 1-65535", c.Calico.KeepAlive)
+		}
+		if c.Calico.HoldTime != 0 && (c.Calico.HoldTime < 3 || c.Calico.HoldTime > 65535) {
+			v.errorf(subpath(cpath, "holdTime"), "invalid holdTime %d, should be 0 (unset) or in range 3-65535", c.Calico.HoldTime)
+		} else if c.Calico.HoldTime != 0 && c.Calico.KeepAlive >= c.Calico.HoldTime {
+			v.errorf(subpath(cpath, "keepAlive"), "keepAlive %d should be less than holdTime %d", c.Calico.KeepAlive, c.Calico.HoldTime)
+		}
+		if c.Calico.EbgpMultihop < 0 || c.Calico.EbgpMultihop > 255 {
+			v.errorf(subpath(cpath, "ebgpMultihop"), "invalid ebgpMultihop %d, should be 0 (unset) or in range 1-255", c.Calico.EbgpMultihop)
+		}
+		if gr := c.Calico.GracefulRestart; gr != nil {
+			if gr.RestartTime < 0 || gr.RestartTime > 3600 {
+				v.errorf(subpath(cpath, "gracefulRestart", "restartTime"), "invalid restartTime %d, should be 0 (unset) or in range 1-3600", gr.RestartTime)
+			}
+			if gr.StalePathTime < 0 || gr.StalePathTime > 3600 {
+				v.errorf(subpath(cpath, "gracefulRestart", "stalePathTime"), "invalid stalePathTime %d, should be 0 (unset) or in range 1-3600", gr.StalePathTime)
+			}
+		}
+		families := map[bool]bool{}
+		for _, selfIP := range c.Calico.SelfIPs {
+			if ip, _, err := net.ParseCIDR(selfIP.IpMask); err == nil {
+				families[ip.To4() == nil] = true
+			}
+		}
+		for i, peerIP := range c.Calico.PeerIPs {
+			if ip := net.ParseIP(peerIP); ip == nil {
+				v.errorf(subpath(cpath, "peerIPs", i), "invalid IP address '%s'", peerIP)
+			} else if len(c.Calico.SelfIPs) > 0 && !families[ip.To4() == nil] {
+				v.errorf(subpath(cpath, "peerIPs", i), "no self IP of the same family with '%s' found", peerIP)
+			} else {
+				v.checkName(subpath(cpath, "peerIPs", i), "BGPPeer", bgpPeerNameOf(peerIP))
+			}
+		}
+	}
+
+	if c.Cilium != nil {
+		cpath := subpath(path, "cilium")
+		tunnels := map[string]string{}
+		for i, t := range c.Cilium.Tunnels {
+			v.checkTunnel(subpath(cpath, "tunnels", i), t.Name, t.ProfileName, t.LocalAddress, t.Port)
+			tunnels[t.Name] = t.LocalAddress
+		}
+		v.checkSelfIPs(subpath(cpath, "selfIPs"), c.Cilium.SelfIPs, tunnels)
+		for i, route := range c.Cilium.Routes {
+			rpath := subpath(cpath, "routes", i)
+			if _, _, err := net.ParseCIDR(route.Network); err != nil {
+				v.errorf(subpath(rpath, "network"), "invalid CIDR '%s'", route.Network)
+			}
+			if _, ok := tunnels[route.TmInterface]; !ok {
+				v.errorf(subpath(rpath, "tmInterface"), "no tunnel named '%s' found", route.TmInterface)
+			}
+		}
+	}
+}
+
+// checkNodeConfig checks the public IP and pod CIDR of a flannel virtual node in one IP family.
+func (v *configValidator) checkNodeConfig(path []interface{}, ipField, cidrField, publicIP, podCIDR string, ipv6 bool,
+	tunnels map[string]string, tunnelNets map[string][]*net.IPNet) {
+	tunnelName := ""
+	for n, addr := range tunnels {
+		if normalizedIP(addr) == normalizedIP(publicIP) {
+			tunnelName = n
+		}
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	if ip := net.ParseIP(publicIP); ip == nil {
+		v.errorf(subpath(path, ipField), "invalid IP address '%s'", publicIP)
+		tunnelName = ""
+	} else if (ip.To4() == nil) != ipv6 {
+		v.errorf(subpath(path, ipField), "'%s' is not an %s address", publicIP, family)
+		tunnelName = ""
+	} else if tunnelName == "" {
+		v.errorf(subpath(path, ipField), "no tunnel with localAddress '%s' found", publicIP)
+	}
+	podIP, podNet, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		v.errorf(subpath(path, cidrField), "invalid CIDR '%s'", podCIDR)
+	} else if (podIP.To4() == nil) != ipv6 {
+		v.errorf(subpath(path, cidrField), "'%s' is not an %s CIDR", podCIDR, family)
+	} else if tunnelName != "" {
+		contained := false
+		podOnes, _ := podNet.Mask.Size()
+		for _, selfNet := range tunnelNets[tunnelName] {
+			selfOnes, _ := selfNet.Mask.Size()
+			if selfNet.Contains(podIP) && podOnes >= selfOnes {
+				contained = true
+			}
+		}
+		if !contained {
+			v.errorf(subpath(path, cidrField), "'%s' is not contained in the network of any self IP on tunnel '%s'", podCIDR, tunnelName)
+		}
+	}
+}
+
+func (v *configValidator) checkTunnel(path []interface{}, name, profileName, localAddress string, port int) {
+	if name == "" {
+		v.errorf(subpath(path, "name"), "name is required")
+	}
+	if profileName == "" {
+		v.errorf(subpath(path, "profileName"), "profileName is required")
+	}
+	if net.ParseIP(localAddress) == nil {
+		v.errorf(subpath(path, "localAddress"), "invalid IP address '%s'", localAddress)
+	}
+	v.checkPort(subpath(path, "port"), port)
+}
+
+// checkSelfIPs validates the self IPs, and requires each of the tunnels to have self IPs on it.
+// It returns the networks of the self IPs by tunnel name.
+func (v *configValidator) checkSelfIPs(path []interface{}, selfIPs []BIGIPSelfIP, tunnels map[string]string) map[string][]*net.IPNet {
+	tunnelNets := map[string][]*net.IPNet{}
+	for i, selfIP := range selfIPs {
+		spath := subpath(path, i)
+		if selfIP.Name == "" {
+			v.errorf(subpath(spath, "name"), "name is required")
+		}
+		if selfIP.VlanOrTunnelName == "" {
+			v.errorf(subpath(spath, "vlanOrTunnelName"), "vlanOrTunnelName is required")
+		}
+		_, ipnet, err := net.ParseCIDR(selfIP.IpMask)
+		if err != nil {
+			v.errorf(subpath(spath, "ipMask"), "invalid CIDR '%s'", selfIP.IpMask)
+		} else if _, ok := tunnels[selfIP.VlanOrTunnelName]; ok {
+			tunnelNets[selfIP.VlanOrTunnelName] = append(tunnelNets[selfIP.VlanOrTunnelName], ipnet)
+		}
+	}
+	for name := range tunnels {
+		if _, ok := tunnelNets[name]; !ok {
+			v.errorf(path, "no self IP with vlanOrTunnelName '%s' found for the tunnel", name)
+		}
+	}
+	return tunnelNets
+}
+
+// checkName checks the name of the k8s object derived from the configuration, i.e. the node of a flannel nodeConfig.
+func (v *configValidator) checkName(path []interface{}, kind, name string) {
+	for _, msg := range validation.IsDNS1123Subdomain(name) {
+		v.errorf(path, "invalid %s name '%s': %s", kind, name, msg)
+	}
+}
+
+func (v *configValidator) checkPort(path []interface{}, port int) {
+	if port <= 0 || port > 65535 {
+		v.errorf(path, "invalid port %d", port)
+	}
+}
+
+func (v *configValidator) checkAS(path []interface{}, as string) {
+	if n, err := strconv.ParseUint(as, 10, 32); err != nil || n == 0 {
+		v.errorf(path, "invalid AS number '%s', should be in range 1-4294967295", as)
+	}
+}
+
+func (v *configValidator) errorf(path []interface{}, format string, a ...interface{}) {
+	entry := -1
+	if len(path) > 0 {
+		if i, ok := path[0].(int); ok {
+			entry = i
+		}
+	}
+	v.errs = append(v.errs, ConfigError{
+		Entry:   entry,
+		Line:    yamlLine(v.root, path),
+		Path:    pathString(path),
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func subpath(path []interface{}, elems ...interface{}) []interface{} {
+	p := append([]interface{}{}, path...)
+	return append(p, elems...)
+}
+
+// pathString formats the path, i.e. [0].flannel.selfIPs[1].ipMask
+func pathString(path []interface{}) string {
+	s := ""
+	for _, e := range path {
+		switch k := e.(type) {
+		case int:
+			s += fmt.Sprintf("[%d]", k)
+		case string:
+			s += "." + k
+		}
+	}
+	return strings.TrimPrefix(s, ".")
+}
+
+// yamlLine returns the line number of the node at path, or that of its nearest existing parent.
+func yamlLine(root *yaml.Node, path []interface{}) int {
+	if root == nil {
+		return 0
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, e := range path {
+		if node.Kind == yaml.AliasNode && node.Alias != nil {
+			node = node.Alias
+		}
+		var next *yaml.Node
+		switch k := e.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && k < len(node.Content) {
+				next = node.Content[k]
+			}
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == k {
+						next = node.Content[i+1]
+					}
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+// yamlKeyPath returns the path of the mapping key named key at the line, i.e. [0].management.pasword, nil if not found.
+func yamlKeyPath(root *yaml.Node, line int, key string) []interface{} {
+	if root == nil {
+		return nil
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	var walk func(node *yaml.Node, path []interface{}) []interface{}
+	walk = func(node *yaml.Node, path []interface{}) []interface{} {
+		switch node.Kind {
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				if p := walk(item, subpath(path, i)); p != nil {
+					return p
+				}
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				k := node.Content[i]
+				if k.Line == line && k.Value == key {
+					return subpath(path, key)
+				}
+				if p := walk(node.Content[i+1], subpath(path, k.Value)); p != nil {
+					return p
+				}
+			}
+		}
+		return nil
+	}
+	return walk(node, []interface{}{})
+}
+
+// yamlEntry returns the index of the configuration entry the line belongs to, -1 if none.
+func yamlEntry(root *yaml.Node, line int) int {
+	if root == nil || root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return -1
+	}
+	entry := -1
+	if seq := root.Content[0]; seq.Kind == yaml.SequenceNode {
+		for i, item := range seq.Content {
+			if item.Line <= line {
+				entry = i
+			}
+		}
+	}
+	return entry
+}
@@ -0,0 +1,294 @@
+package cnisetup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const flannelConfig = `- management:
+    username: admin
+    ipAddress: 10.250.2.219
+    insecureSkipVerify: true
+  flannel:
+    tunnels:
+      - name: fl-tunnel
+        profileName: fl-vxlan
+        port: 8472
+        localAddress: 10.250.17.219
+    selfIPs:
+      - name: flannel-self
+        ipMask: 10.42.20.1/16
+        vlanOrTunnelName: fl-tunnel
+    nodeConfigs:
+      - publicIP: 10.250.17.219
+        podCIDR: 10.42.20.0/24
+`
+
+func validateYaml(t *testing.T, content string) *ValidationReport {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	report, err := (&CNIConfigs{}).Validate(configPath)
+	if err != nil {
+		t.Fatalf("failed to validate: %s", err.Error())
+	}
+	return report
+}
+
+func allErrors(report *ValidationReport) ConfigErrors {
+	errs := append(ConfigErrors{}, report.Errors...)
+	for _, entry := range report.Entries {
+		errs = append(errs, entry.Errors...)
+	}
+	return errs
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    ConfigErrors
+	}{
+		{
+			name:    "valid",
+			content: flannelConfig,
+			want:    ConfigErrors{},
+		},
+		{
+			name:    "unknown field",
+			content: strings.Replace(flannelConfig, "insecureSkipVerify", "insecureSkipVerfy", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 4, Path: "[0].management.insecureSkipVerfy", Message: "unknown field"},
+			},
+		},
+		{
+			name:    "unknown field in the second entry",
+			content: flannelConfig + strings.Replace(strings.Replace(flannelConfig, "10.250.2.219", "10.250.2.220", 1), "  podCIDR", "  podCIDRS", 1),
+			want: ConfigErrors{
+				{Entry: 1, Line: 34, Path: "[1].flannel.nodeConfigs[0].podCIDRS", Message: "unknown field"},
+				{Entry: 1, Line: 33, Path: "[1].flannel.nodeConfigs[0].podCIDR", Message: "invalid CIDR ''"},
+			},
+		},
+		{
+			name:    "invalid port",
+			content: strings.Replace(flannelConfig, "port: 8472", "port: 0", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 9, Path: "[0].flannel.tunnels[0].port", Message: "invalid port 0"},
+			},
+		},
+		{
+			name:    "no self IP on the tunnel",
+			content: strings.Replace(flannelConfig, "vlanOrTunnelName: fl-tunnel", "vlanOrTunnelName: vlan-17", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 12, Path: "[0].flannel.selfIPs", Message: "no self IP with vlanOrTunnelName 'fl-tunnel'"},
+				{Entry: 0, Line: 17, Path: "[0].flannel.nodeConfigs[0].podCIDR", Message: "is not contained in the network"},
+			},
+		},
+		{
+			name:    "public IP of no tunnel",
+			content: strings.Replace(flannelConfig, "publicIP: 10.250.17.219", "publicIP: 10.250.17.220", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 16, Path: "[0].flannel.nodeConfigs[0].publicIP", Message: "no tunnel with localAddress '10.250.17.220'"},
+			},
+		},
+		{
+			name:    "pod CIDR out of the self IP network",
+			content: strings.Replace(flannelConfig, "podCIDR: 10.42.20.0/24", "podCIDR: 10.43.20.0/24", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 17, Path: "[0].flannel.nodeConfigs[0].podCIDR", Message: "is not contained in the network"},
+			},
+		},
+		{
+			name:    "pod CIDR of the other family",
+			content: strings.Replace(flannelConfig, "podCIDR: 10.42.20.0/24", "podCIDR: fd00::/64", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 17, Path: "[0].flannel.nodeConfigs[0].podCIDR", Message: "is not an IPv4 CIDR"},
+			},
+		},
+		{
+			name: "route to no tunnel",
+			content: `- management:
+    username: admin
+    ipAddress: 10.250.2.220
+  cilium:
+    tunnels:
+      - name: fl-tunnel
+        profileName: fl-vxlan
+        port: 8472
+        localAddress: 10.250.16.105
+    selfIPs:
+      - name: flannel-self
+        ipMask: 10.0.20.1/24
+        vlanOrTunnelName: fl-tunnel
+    routes:
+      - network: 10.0.0.0/16
+        tmInterface: fl-tunel
+`,
+			want: ConfigErrors{
+				{Entry: 0, Line: 16, Path: "[0].cilium.routes[0].tmInterface", Message: "no tunnel named 'fl-tunel'"},
+			},
+		},
+		{
+			name: "calico timers out of range",
+			content: `- management:
+    username: admin
+    ipAddress: 10.250.2.220
+  calico:
+    localAS: 64512
+    remoteAS: 64512
+    keepAlive: 0
+    holdTime: 2
+    ebgpMultihop: 256
+    gracefulRestart:
+      restartTime: -1
+`,
+			want: ConfigErrors{
+				{Entry: 0, Line: 8, Path: "[0].calico.holdTime", Message: "should be 0 (unset) or in range 3-65535"},
+				{Entry: 0, Line: 9, Path: "[0].calico.ebgpMultihop", Message: "should be 0 (unset) or in range 1-255"},
+				{Entry: 0, Line: 11, Path: "[0].calico.gracefulRestart.restartTime", Message: "should be 0 (unset) or in range 1-3600"},
+			},
+		},
+		{
+			name: "IPv6 public IP in other notation",
+			content: `- management:
+    username: admin
+    ipAddress: 10.250.2.220
+  flannel:
+    tunnels:
+      - name: fl-tunnel6
+        profileName: fl-vxlan6
+        port: 8472
+        localAddress: "2001:db8::"
+    selfIPs:
+      - name: flannel-self6
+        ipMask: fd00:42::1/56
+        vlanOrTunnelName: fl-tunnel6
+    nodeConfigs:
+      - publicIPv6: "2001:DB8:0:0::"
+        podCIDRv6: fd00:42:0:14::/64
+`,
+			want: ConfigErrors{},
+		},
+		{
+			name:    "yaml syntax error",
+			content: strings.Replace(flannelConfig, "localAddress: 10.250.17.219", "localAddress: 2001:db8::", 1),
+			want: ConfigErrors{
+				{Entry: -1, Line: 10, Path: "", Message: "mapping values are not allowed in this context"},
+			},
+		},
+		{
+			name:    "duplicate names on the same BIG-IP and partition",
+			content: flannelConfig + flannelConfig,
+			want: ConfigErrors{
+				{Entry: 1, Line: 24, Path: "[1].flannel.tunnels[0].name", Message: "duplicate tunnel name 'fl-tunnel' on the same BIG-IP and partition, also defined at [0].flannel.tunnels[0].name"},
+				{Entry: 1, Line: 29, Path: "[1].flannel.selfIPs[0].name", Message: "duplicate self IP name 'flannel-self'"},
+			},
+		},
+		{
+			name: "shared vxlan profile of different ports",
+			content: flannelConfig + strings.Replace(strings.ReplaceAll(strings.ReplaceAll(flannelConfig, "fl-tunnel", "fl-tunnel2"),
+				"flannel-self", "flannel-self2"), "port: 8472", "port: 4789", 1),
+			want: ConfigErrors{
+				{Entry: 1, Line: 25, Path: "[1].flannel.tunnels[0].profileName", Message: "duplicate vxlan profile name 'fl-vxlan'"},
+			},
+		},
+		{
+			name:    "same names on another partition",
+			content: flannelConfig + strings.Replace(flannelConfig, "  flannel:\n", "  partition: k8s\n  flannel:\n", 1),
+			want:    ConfigErrors{},
+		},
+		{
+			name:    "missing field located at its parent",
+			content: strings.Replace(flannelConfig, "    username: admin\n", "", 1),
+			want: ConfigErrors{
+				{Entry: 0, Line: 2, Path: "[0].management.username", Message: "username is required"},
+			},
+		},
+		{
+			name:    "no entry",
+			content: "[]\n",
+			want: ConfigErrors{
+				{Entry: -1, Line: 1, Path: "", Message: "no BIG-IP configured"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			report := validateYaml(t, tc.content)
+			got := allErrors(report)
+			if report.Valid != (len(tc.want) == 0) {
+				t.Errorf("valid: got %t, errors: %v", report.Valid, got)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d error(s), want %d: %v", len(got), len(tc.want), got)
+			}
+			for _, want := range tc.want {
+				found := false
+				for _, ce := range got {
+					if ce.Entry == want.Entry && ce.Line == want.Line && ce.Path == want.Path && strings.Contains(ce.Message, want.Message) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("error %+v not found in %v", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	report, err := (&CNIConfigs{}).Validate("../configs/config.yaml.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid {
+		t.Errorf("template should be valid: %v", allErrors(report))
+	}
+}
+
+func TestYamlLocation(t *testing.T) {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(flannelConfig+flannelConfig), &root); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path  []interface{}
+		line  int
+		entry int
+	}{
+		{path: []interface{}{}, line: 1, entry: 0},
+		{path: []interface{}{0, "management", "ipAddress"}, line: 3, entry: 0},
+		{path: []interface{}{0, "flannel", "selfIPs", 0, "ipMask"}, line: 13, entry: 0},
+		{path: []interface{}{1, "flannel", "nodeConfigs", 0, "podCIDR"}, line: 34, entry: 1},
+		// the nearest existing parent.
+		{path: []interface{}{1, "management", "port"}, line: 19, entry: 1},
+		{path: []interface{}{1, "flannel", "tunnels", 3}, line: 24, entry: 1},
+	}
+	for _, tc := range cases {
+		line := yamlLine(&root, tc.path)
+		if line != tc.line {
+			t.Errorf("yamlLine(%s): got %d, want %d", pathString(tc.path), line, tc.line)
+		}
+		if entry := yamlEntry(&root, line); entry != tc.entry {
+			t.Errorf("yamlEntry(%d): got %d, want %d", line, entry, tc.entry)
+		}
+	}
+	if entry := yamlEntry(&root, 0); entry != -1 {
+		t.Errorf("yamlEntry(0): got %d, want -1", entry)
+	}
+
+	if path := pathString(yamlKeyPath(&root, 34, "podCIDR")); path != "[1].flannel.nodeConfigs[0].podCIDR" {
+		t.Errorf("yamlKeyPath: got '%s'", path)
+	}
+	if path := yamlKeyPath(&root, 33, "podCIDR"); path != nil {
+		t.Errorf("yamlKeyPath: got %v, want nil", path)
+	}
+}
@@ -0,0 +1,230 @@
+package cnisetup
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"f5-tool-setup-cni/third_party/f5-bigip-rest-go/utils"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// bgpVerifyInterval is the interval of querying the bgp session states.
+const bgpVerifyInterval = 5 * time.Second
+
+// bgpSession is the state of a bgp session seen from one side, i.e. BIG-IP or a calico node.
+type bgpSession struct {
+	Side  string
+	Peer  string
+	State string
+}
+
+var (
+	reBGPNeighbor = regexp.MustCompile(`BGP neighbor is ([^,\s]+),`)
+	reBGPState    = regexp.MustCompile(`BGP state = (\w+)`)
+)
+
+// VerifyBGP waits until the bgp sessions between BIG-IPs and the calico nodes are established, or timeout,
+// then reports the state of each session from both sides, and returns error if any of them is not established.
+func (cnictx *CNIContext) VerifyBGP(timeout time.Duration) error {
+	slog := utils.LogFromContext(cnictx)
+	cs := []*CNIConfig{}
+	for i := range cnictx.CNIConfigs {
+		if cnictx.CNIConfigs[i].Calico != nil {
+			cs = append(cs, &cnictx.CNIConfigs[i])
+		}
+	}
+	if len(cs) == 0 {
+		return nil
+	}
+
+	k8sclient, err := kubeClientOf(cs[0].kubeConfig)
+	if err != nil {
+		return err
+	}
+	nodeList, err := k8sclient.CoreV1().Nodes().List(cnictx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	calicoset, err := calicoClientOf(cs[0].kubeConfig)
+	if err != nil {
+		return err
+	}
+	// the CalicoNodeStatus created by this run by node name, empty if not supported.
+	statuses := map[string]string{}
+	defer func() {
+		for _, name := range statuses {
+			if name == "" {
+				continue
+			}
+			err := calicoset.Resource(gvrCalicoNodeStatus).Delete(context.TODO(), name, metav1.DeleteOptions{})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				slog.Warnf("failed to delete CalicoNodeStatus %s, delete it manually: %s", name, err.Error())
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		sessions := []bgpSession{}
+		for _, c := range cs {
+			addrs, nodes, err := c.bgpNeighbors(cnictx, nodeList)
+			if err != nil {
+				return err
+			}
+			bigipSessions, err := c.bigipBGPSessions(cnictx, addrs)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, bigipSessions...)
+
+			for i := range nodes.Items {
+				nodeSessions, err := c.calicoBGPSessions(cnictx, &nodes.Items[i], statuses)
+				if err != nil {
+					return err
+				}
+				sessions = append(sessions, nodeSessions...)
+			}
+		}
+
+		failed := []string{}
+		for _, s := range sessions {
+			if s.State != "Established" {
+				failed = append(failed, fmt.Sprintf("%s -> %s: %s", s.Side, s.Peer, s.State))
+			}
+		}
+		if len(failed) == 0 || time.Now().After(deadline) {
+			for _, s := range sessions {
+				slog.Infof("bgp session %s -> %s: %s", s.Side, s.Peer, s.State)
+			}
+			if len(failed) > 0 {
+				return fmt.Errorf("bgp sessions not established in %s, check the AS numbers, peer IPs and passwords: %s",
+					timeout, strings.Join(failed, "; "))
+			}
+			return nil
+		}
+		slog.Debugf("waiting for bgp sessions: %s", strings.Join(failed, "; "))
+		time.Sleep(bgpVerifyInterval)
+	}
+}
+
+// bigipBGPSessions returns the session states of the neighbors on BIG-IP, Unknown for the ones not found.
+func (cniconf *CNIConfig) bigipBGPSessions(ctx context.Context, addrs []string) ([]bgpSession, error) {
+	bc, err := cniconf.newBIGIPContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the quotes are escaped for both the bash and the tmsh command lines of bc.Tmsh.
+	resp, err := bc.Tmsh(fmt.Sprintf(`run util imish -r %d -e \"show ip bgp neighbors\"`, cniconf.routeDomain()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bgp neighbors of BIG-IP %s: %s", cniconf.Management.IpAddress, countRestError(bc, "util/bash", err).Error())
+	}
+	output, _ := (*resp)["commandResult"].(string)
+
+	// the output is of blocks beginning with 'BGP neighbor is <address>, ...' and containing 'BGP state = <state>, ...'
+	states := map[string]string{}
+	neighbor := ""
+	for _, line := range strings.Split(output, "\n") {
+		if m := reBGPNeighbor.FindStringSubmatch(line); m != nil {
+			neighbor = normalizedIP(m[1])
+		} else if m := reBGPState.FindStringSubmatch(line); m != nil && neighbor != "" {
+			states[neighbor] = m[1]
+		}
+	}
+
+	sessions := []bgpSession{}
+	for _, addr := range addrs {
+		state, ok := states[normalizedIP(addr)]
+		if !ok {
+			state = "Unknown"
+		}
+		sessions = append(sessions, bgpSession{Side: "BIG-IP " + cniconf.Management.IpAddress, Peer: addr, State: state})
+	}
+	return sessions, nil
+}
+
+var gvrCalicoNodeStatus = schema.GroupVersionResource{
+	Group:    "crd.projectcalico.org",
+	Version:  "v1",
+	Resource: "caliconodestatuses",
+}
+
+// calicoBGPSessions returns the session states of the node with peerIPs of its families, from CalicoNodeStatus,
+// which is created with a generated name for the node if not yet, and recorded in statuses for deleting after verification.
+// It returns nothing if CalicoNodeStatus is not supported, i.e. calico < v3.22.
+func (cniconf *CNIConfig) calicoBGPSessions(ctx context.Context, node *v1.Node, statuses map[string]string) ([]bgpSession, error) {
+	slog := utils.LogFromContext(ctx)
+	calicoset, err := calicoClientOf(cniconf.kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	nodeName := node.Name
+	nIpv4s, nIpv6s := allNodeIpAddrs(ctx, &v1.NodeList{Items: []v1.Node{*node}})
+	if len(nIpv4s)+len(nIpv6s) == 0 {
+		return nil, nil
+	}
+
+	if _, ok := statuses[nodeName]; !ok {
+		status := unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "crd.projectcalico.org/v1",
+				"kind":       "CalicoNodeStatus",
+				"metadata":   map[string]interface{}{"generateName": "setup-cni-" + nodeName + "-"},
+				"spec": map[string]interface{}{
+					"node":                nodeName,
+					"classes":             []interface{}{"BGP"},
+					"updatePeriodSeconds": int64(bgpVerifyInterval.Seconds()),
+				},
+			},
+		}
+		created, err := calicoset.Resource(gvrCalicoNodeStatus).Create(context.TODO(), &status, metav1.CreateOptions{})
+		if k8serrors.IsNotFound(err) {
+			slog.Warnf("CalicoNodeStatus is not supported, skipped verifying bgp sessions on node %s", nodeName)
+			statuses[nodeName] = ""
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		statuses[nodeName] = created.GetName()
+	}
+	if statuses[nodeName] == "" {
+		return nil, nil
+	}
+
+	obj, err := calicoset.Resource(gvrCalicoNodeStatus).Get(context.TODO(), statuses[nodeName], metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	states := map[string]string{}
+	for _, field := range []string{"peersV4", "peersV6"} {
+		peers, _, _ := unstructured.NestedSlice(obj.Object, "status", "bgp", field)
+		for _, p := range peers {
+			peer, _ := p.(map[string]interface{})
+			peerIP, _ := peer["peerIP"].(string)
+			state, _ := peer["state"].(string)
+			states[normalizedIP(peerIP)] = state
+		}
+	}
+
+	sessions := []bgpSession{}
+	peerIPs := append([]string{}, cniconf.Calico.PeerIPs...)
+	sort.Strings(peerIPs)
+	for _, peerIP := range peerIPs {
+		if (isIPv6(peerIP) && len(nIpv6s) == 0) || (!isIPv6(peerIP) && len(nIpv4s) == 0) {
+			continue
+		}
+		state, ok := states[normalizedIP(peerIP)]
+		if !ok {
+			state = "Unknown"
+		}
+		sessions = append(sessions, bgpSession{Side: "node " + nodeName, Peer: peerIP, State: state})
+	}
+	return sessions, nil
+}
@@ -0,0 +1,47 @@
+package cnisetup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBigipBGPSessions(t *testing.T) {
+	args := ""
+	c := fakeBIGIP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "POST" && r.URL.Path == "/mgmt/tm/util/bash" {
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			args = body["utilCmdArgs"]
+			output := "BGP neighbor is 10.250.17.111, remote AS 64512, local AS 64512, internal link\n" +
+				"  BGP version 4, remote router ID 10.250.17.111\n" +
+				"  BGP state = Established, up for 00:10:01\n" +
+				"BGP neighbor is 10.250.17.112, remote AS 64512, local AS 64512, internal link\n" +
+				"  BGP state = Active\n"
+			json.NewEncoder(w).Encode(map[string]string{"kind": "tm:util:bash:runstate", "commandResult": output})
+			return
+		}
+		io.WriteString(w, `{}`)
+	})
+	rd := 2
+	c.RouteDomain = &rd
+
+	sessions, err := c.bigipBGPSessions(context.TODO(), []string{"10.250.17.111", "10.250.17.112", "10.250.17.113"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `-c 'tmsh -c "run util imish -r 2 -e \"show ip bgp neighbors\""'`; args != want {
+		t.Errorf("utilCmdArgs: got %s, want %s", args, want)
+	}
+	states := []string{}
+	for _, s := range sessions {
+		states = append(states, s.Peer+" "+s.State)
+	}
+	if want := []string{"10.250.17.111 Established", "10.250.17.112 Active", "10.250.17.113 Unknown"}; !reflect.DeepEqual(states, want) {
+		t.Errorf("got %v, want %v", states, want)
+	}
+}
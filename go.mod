@@ -13,8 +13,8 @@ require (
 )
 
 require (
-	github.com/f5devcentral/f5-bigip-rest-go v1.0.9
 	github.com/google/uuid v1.3.0
+	github.com/prometheus/client_golang v1.14.0
 	k8s.io/api v0.26.1
 	sigs.k8s.io/controller-runtime v0.14.4
 )
@@ -45,7 +45,6 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/prometheus/client_golang v1.14.0 // indirect
 	github.com/prometheus/client_model v0.3.0 // indirect
 	github.com/prometheus/common v0.37.0 // indirect
 	github.com/prometheus/procfs v0.8.0 // indirect
@@ -0,0 +1,11 @@
+package utils
+
+import "log"
+
+type SLOG struct {
+	Level     int
+	requestID string
+	loggers   map[int]*log.Logger
+}
+
+type CtxKeyType string